@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+	API keys are read from the YAML file given with -api-keys. Only the SHA-256 of each key is
+	stored, so the file doesn't give away the keys themselves. Keys are sent as bearer tokens,
+	and each route declares the scopes it requires with requireScopes, see auth.go.
+*/
+
+// APIKey is a key in the -api-keys file. Hash is "sha256:" followed by the hex SHA-256 of the key.
+// Roles pick the key's policies in the -policies file.
+type APIKey struct {
+	Name   string   `yaml:"name"`
+	Hash   string   `yaml:"hash"`
+	Scopes []string `yaml:"scopes"`
+	Roles  []string `yaml:"roles"`
+}
+
+// apiKeysFile is the format of the -api-keys file
+type apiKeysFile struct {
+	Keys []APIKey `yaml:"keys"`
+}
+
+var apiKeysPath string
+
+// apiKeys maps the hashes of the keys in apiKeysPath to the keys. It is nil without -api-keys.
+var apiKeys map[string]APIKey
+var apiKeysLock sync.RWMutex
+
+// loadAPIKeys reads the -api-keys file, replacing the keys in use only if the whole file is valid
+func loadAPIKeys(path string) error {
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config apiKeysFile
+	if err := yaml.UnmarshalStrict(text, &config); err != nil {
+		return err
+	}
+	keys := make(map[string]APIKey, len(config.Keys))
+	for _, key := range config.Keys {
+		if key.Name == "" {
+			return fmt.Errorf("API key without a name")
+		}
+		hash := strings.TrimPrefix(key.Hash, "sha256:")
+		if decoded, err := hex.DecodeString(hash); err != nil || hash == key.Hash || len(decoded) != sha256.Size {
+			return fmt.Errorf("API key '%s' must have a hash like sha256:<64 hex digits>", key.Name)
+		}
+		for _, scope := range key.Scopes {
+			if !knownScopes[scope] {
+				return fmt.Errorf("API key '%s' has unknown scope '%s'", key.Name, scope)
+			}
+		}
+		hash = strings.ToLower(hash)
+		if _, ok := keys[hash]; ok {
+			return fmt.Errorf("API key '%s' has the same hash as another key", key.Name)
+		}
+		keys[hash] = key
+	}
+	apiKeysLock.Lock()
+	defer apiKeysLock.Unlock()
+	apiKeys = keys
+	return nil
+}
+
+// watchAPIKeys reloads the -api-keys file every interval if it has changed. If the new file
+// is invalid, the keys already loaded stay in use.
+func watchAPIKeys(path string, interval time.Duration) {
+	last, _ := signatureOf(path)
+	for range time.Tick(interval) {
+		signature, err := signatureOf(path)
+		if err != nil || signature == last {
+			continue
+		}
+		last = signature
+		if err := loadAPIKeys(path); err != nil {
+			log.Println("API keys file error, keeping the previous keys:", err)
+		} else {
+			log.Println("Reloaded API keys file:", path)
+		}
+	}
+}
+
+// apiKeysEnabled is true if pwaas was started with -api-keys
+func apiKeysEnabled() bool {
+	apiKeysLock.RLock()
+	defer apiKeysLock.RUnlock()
+	return apiKeys != nil
+}
+
+// lookupAPIKey finds the key sent as the request's bearer token
+func lookupAPIKey(c echo.Context) (APIKey, bool) {
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token == auth || token == "" {
+		return APIKey{}, false
+	}
+	hash := sha256.Sum256([]byte(token))
+	apiKeysLock.RLock()
+	defer apiKeysLock.RUnlock()
+	key, ok := apiKeys[hex.EncodeToString(hash[:])]
+	return key, ok
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func keyHash(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+func writeAPIKeys(t *testing.T, path string, scopes map[string]string) {
+	text := "keys:\n"
+	for key, keyScopes := range scopes {
+		text += fmt.Sprintf("  - name: %s\n    hash: %s\n    scopes: [%s]\n", key, keyHash(key), keyScopes)
+	}
+	assert.NoError(t, ioutil.WriteFile(path, []byte(text), 0600))
+}
+
+func serveWithKey(e *echo.Echo, method, path, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if key != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+key)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pwaas")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func() { apiKeys = nil }()
+	path := filepath.Join(dir, "keys.yaml")
+
+	writeAPIKeys(t, path, map[string]string{"reader": "users:read, groups:read"})
+	assert.NoError(t, loadAPIKeys(path))
+	assert.True(t, apiKeysEnabled())
+
+	for _, invalid := range []string{
+		"keys:\n  - hash: " + keyHash("a") + "\n",
+		"keys:\n  - name: a\n    hash: " + keyHash("a")[7:] + "\n",
+		"keys:\n  - name: a\n    hash: sha256:abc\n",
+		"keys:\n  - name: a\n    hash: " + keyHash("a") + "\n    scopes: [everything]\n",
+		"keys:\n  - name: a\n    hash: " + keyHash("a") + "\n  - name: b\n    hash: " + keyHash("a") + "\n",
+		"keys:\n  - name: a\n    key: a\n",
+	} {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(invalid), 0600))
+		assert.Error(t, loadAPIKeys(path), invalid)
+	}
+	// The last valid keys stay in use
+	assert.Len(t, apiKeys, 1)
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pwaas")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func() { apiKeys = nil }()
+	path := filepath.Join(dir, "keys.yaml")
+	e := newServer()
+
+	// Everything is open without -api-keys
+	assert.Equal(t, http.StatusOK, serveWithKey(e, echo.GET, "/v1/users", "").Code)
+	assert.Equal(t, http.StatusForbidden, serveWithKey(e, echo.POST, "/v1/admin/reload", "").Code)
+
+	writeAPIKeys(t, path, map[string]string{
+		"reader":   "users:read, groups:read",
+		"searcher": "users:read, search",
+		"operator": "admin",
+	})
+	assert.NoError(t, loadAPIKeys(path))
+
+	for _, key := range []string{"", "wrong"} {
+		rec := serveWithKey(e, echo.GET, "/v1/users", key)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Equal(t, codeUnauthorized, parseProblem(t, rec.Body.Bytes()).Code)
+		assert.Equal(t, "Bearer", rec.Header().Get(echo.HeaderWWWAuthenticate))
+	}
+
+	tests := []struct {
+		method, path, key string
+		status            int
+	}{
+		{echo.GET, "/v1/users", "reader", http.StatusOK},
+		{echo.GET, "/users", "reader", http.StatusOK},
+		{echo.GET, "/v1/groups", "reader", http.StatusOK},
+		{echo.GET, "/v1/stats", "reader", http.StatusOK},
+		{echo.GET, "/v1/stats", "searcher", http.StatusForbidden},
+		{echo.GET, "/v1/groups", "searcher", http.StatusForbidden},
+		{echo.GET, "/v1/users/search?q=root", "reader", http.StatusForbidden},
+		{echo.GET, "/v1/users/search?q=root", "searcher", http.StatusOK},
+		{echo.POST, "/v1/plan", "reader", http.StatusForbidden},
+		{echo.POST, "/v1/admin/reload", "reader", http.StatusForbidden},
+		{echo.POST, "/v1/admin/reload", "operator", http.StatusOK},
+		{echo.GET, "/v1/users", "operator", http.StatusForbidden},
+		// Open to everyone
+		{echo.GET, "/v1/healthcheck", "", http.StatusOK},
+		{echo.GET, "/v1/livez", "", http.StatusOK},
+		{echo.GET, "/v1/openapi.json", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		rec := serveWithKey(e, test.method, test.path, test.key)
+		assert.Equal(t, test.status, rec.Code, test.method+" "+test.path+" as "+test.key)
+		if rec.Code == http.StatusForbidden {
+			assert.Equal(t, codeInsufficientScope, parseProblem(t, rec.Body.Bytes()).Code)
+			assert.Contains(t, rec.Header().Get(echo.HeaderWWWAuthenticate), `error="insufficient_scope"`)
+		}
+	}
+
+	// The admin token keeps working alongside API keys
+	adminToken = "secret"
+	defer func() { adminToken = "" }()
+	assert.Equal(t, http.StatusOK, serveWithKey(e, echo.POST, "/v1/admin/reload", "secret").Code)
+
+	// Changes to the file are picked up
+	go watchAPIKeys(path, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	writeAPIKeys(t, path, map[string]string{"reader": "users:read, groups:read, search"})
+	eventually(t, func() bool {
+		return serveWithKey(e, echo.GET, "/v1/users/search?q=root", "reader").Code == http.StatusOK
+	}, "API keys reload")
+	assert.Equal(t, http.StatusUnauthorized, serveWithKey(e, echo.GET, "/v1/users", "searcher").Code)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+/*
+	Callers authenticate with an API key (-api-keys) or a client certificate (-client-ca with
+	-client-roles), and are granted scopes. Each route declares the scopes it requires with
+	requireScopes. Without either option, authentication is off and every route is open.
+*/
+
+// Scopes granted to API keys and client certificate roles
+const (
+	scopeUsersRead  = "users:read"
+	scopeGroupsRead = "groups:read"
+	scopeSearch     = "search"
+	scopeWrite      = "write"
+	scopeAdmin      = "admin"
+)
+
+var knownScopes = map[string]bool{
+	scopeUsersRead:  true,
+	scopeGroupsRead: true,
+	scopeSearch:     true,
+	scopeWrite:      true,
+	scopeAdmin:      true,
+}
+
+// Ways a caller can authenticate
+const (
+	authAPIKey      = "api_key"
+	authCertificate = "certificate"
+)
+
+// contextCaller is the echo context key of the Caller a request authenticated as
+const contextCaller = "caller"
+
+// Caller is who made a request, and the roles that pick its policies. Certificate callers
+// also report the certificate's subject and SANs.
+type Caller struct {
+	Authenticated bool     `json:"authenticated"`
+	Method        string   `json:"method,omitempty"`
+	Name          string   `json:"name,omitempty"`
+	Subject       string   `json:"subject,omitempty"`
+	DNSNames      []string `json:"dns_names,omitempty"`
+	URIs          []string `json:"uris,omitempty"`
+	Emails        []string `json:"emails,omitempty"`
+	Roles         []string `json:"roles"`
+	Scopes        []string `json:"scopes"`
+}
+
+// hasScope checks whether a caller was granted a scope
+func (caller Caller) hasScope(scope string) bool {
+	for _, granted := range caller.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// authEnabled is true if pwaas was started with -api-keys or -client-roles
+func authEnabled() bool {
+	return apiKeysEnabled() || clientRoles != nil
+}
+
+// authenticate works out who made a request. An API key takes precedence over a client certificate.
+func authenticate(c echo.Context) Caller {
+	if key, ok := lookupAPIKey(c); ok {
+		return Caller{Authenticated: true, Method: authAPIKey, Name: key.Name, Roles: append([]string{}, key.Roles...), Scopes: append([]string{}, key.Scopes...)}
+	}
+	if tls := c.Request().TLS; tls != nil && clientRoles != nil && len(tls.VerifiedChains) > 0 {
+		return certificateCaller(tls.VerifiedChains[0][0])
+	}
+	return Caller{Roles: []string{}, Scopes: []string{}}
+}
+
+// requestCaller is the caller stored in the context by requireScopes, or else who the request authenticates as
+func requestCaller(c echo.Context) Caller {
+	if caller, ok := c.Get(contextCaller).(Caller); ok {
+		return caller
+	}
+	return authenticate(c)
+}
+
+// requireScopes rejects requests from callers that don't have all of the scopes, if authentication
+// is enabled. The caller is stored in the context as contextCaller.
+func requireScopes(scopes ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !authEnabled() {
+				return next(c)
+			}
+			caller := authenticate(c)
+			if !caller.Authenticated {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+				return errUnauthorized
+			}
+			for _, scope := range scopes {
+				if !caller.hasScope(scope) {
+					c.Response().Header().Set(echo.HeaderWWWAuthenticate, fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, strings.Join(scopes, " ")))
+					return &APIError{
+						Status: http.StatusForbidden,
+						Code:   codeInsufficientScope,
+						Detail: fmt.Sprintf("'%s' doesn't have the '%s' scope", caller.Name, scope),
+					}
+				}
+			}
+			c.Set(contextCaller, caller)
+			return next(c)
+		}
+	}
+}
+
+// whoami reports who the request authenticated as, and what it may do
+func whoami(c echo.Context) error {
+	return c.JSON(http.StatusOK, authenticate(c))
+}
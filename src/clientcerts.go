@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+	With -tls-cert and -tls-key, pwaas serves HTTPS with its own certificate instead of
+	autocert. Adding -client-ca makes clients present a certificate signed by that CA, and
+	-client-roles maps certificate subjects and SANs to roles, which grant scopes just like
+	API keys do.
+*/
+
+var tlsCertPath, tlsKeyPath, clientCAPath, clientRolesPath string
+
+// ClientIdentity maps the certificates it matches to roles. Every field that is set must match,
+// with * wildcards. DNSName, URI and Email match any of the certificate's SANs of that type.
+type ClientIdentity struct {
+	CommonName string   `yaml:"common_name"`
+	DNSName    string   `yaml:"dns_name"`
+	URI        string   `yaml:"uri"`
+	Email      string   `yaml:"email"`
+	Roles      []string `yaml:"roles"`
+}
+
+// clientRolesFile is the format of the -client-roles file: the scopes of each role,
+// and the roles of the clients
+type clientRolesFile struct {
+	Roles   map[string][]string `yaml:"roles"`
+	Clients []ClientIdentity    `yaml:"clients"`
+}
+
+// clientRoles is the loaded -client-roles file, nil if certificates aren't mapped to roles
+var clientRoles *clientRolesFile
+
+// loadClientRoles reads and checks the -client-roles file
+func loadClientRoles(configPath string) error {
+	text, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	var config clientRolesFile
+	if err := yaml.UnmarshalStrict(text, &config); err != nil {
+		return err
+	}
+	for role, scopes := range config.Roles {
+		for _, scope := range scopes {
+			if !knownScopes[scope] {
+				return fmt.Errorf("role '%s' has unknown scope '%s'", role, scope)
+			}
+		}
+	}
+	for i, client := range config.Clients {
+		patterns := []string{client.CommonName, client.DNSName, client.URI, client.Email}
+		if client.CommonName == "" && client.DNSName == "" && client.URI == "" && client.Email == "" {
+			return fmt.Errorf("client %d doesn't match anything - set common_name, dns_name, uri or email", i+1)
+		}
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("client %d has invalid pattern '%s'", i+1, pattern)
+			}
+		}
+		for _, role := range client.Roles {
+			if _, ok := config.Roles[role]; !ok {
+				return fmt.Errorf("client %d has undefined role '%s'", i+1, role)
+			}
+		}
+	}
+	clientRoles = &config
+	return nil
+}
+
+// mutualTLSConfig loads the server's certificate, and requires clients to present
+// a certificate signed by the CAs in caFile
+func mutualTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return config, nil
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// matchesAny checks whether pattern is empty or matches one of values
+func matchesAny(pattern string, values []string) bool {
+	if pattern == "" {
+		return true
+	}
+	for _, value := range values {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// certificateCaller identifies a verified client certificate, with the roles and scopes
+// of every client identity it matches. Certificates that match none get no scopes.
+func certificateCaller(cert *x509.Certificate) Caller {
+	caller := Caller{
+		Authenticated: true,
+		Method:        authCertificate,
+		Name:          cert.Subject.CommonName,
+		Subject:       cert.Subject.String(),
+		DNSNames:      cert.DNSNames,
+		Emails:        cert.EmailAddresses,
+	}
+	for _, uri := range cert.URIs {
+		caller.URIs = append(caller.URIs, uri.String())
+	}
+	roles, scopes := make(map[string]bool), make(map[string]bool)
+	for _, client := range clientRoles.Clients {
+		if !matchesAny(client.CommonName, []string{cert.Subject.CommonName}) || !matchesAny(client.DNSName, caller.DNSNames) ||
+			!matchesAny(client.URI, caller.URIs) || !matchesAny(client.Email, caller.Emails) {
+			continue
+		}
+		for _, role := range client.Roles {
+			roles[role] = true
+			for _, scope := range clientRoles.Roles[role] {
+				scopes[scope] = true
+			}
+		}
+	}
+	caller.Roles, caller.Scopes = sortedSet(roles), sortedSet(scopes)
+	return caller
+}
+
+func sortedSet(set map[string]bool) []string {
+	keys := []string{}
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
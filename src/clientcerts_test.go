@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCA issues certificates for TLS tests
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "pwaas test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+// issue creates a certificate signed by the CA from template, returning it with its key
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) (tls.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	ca.serial++
+	template.SerialNumber = big.NewInt(ca.serial)
+	template.NotBefore, template.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.NoError(t, err)
+	return pair, certPEM, keyPEM
+}
+
+func (ca *testCA) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+func TestLoadClientRoles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pwaas")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func() { clientRoles = nil }()
+	path := filepath.Join(dir, "roles.yaml")
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("roles:\n  reader: [users:read]\nclients:\n  - dns_name: '*.example.com'\n    roles: [reader]\n"), 0600))
+	assert.NoError(t, loadClientRoles(path))
+	assert.NotNil(t, clientRoles)
+
+	for _, invalid := range []string{
+		"roles:\n  reader: [everything]\n",
+		"clients:\n  - roles: [reader]\n",
+		"roles:\n  reader: [users:read]\nclients:\n  - common_name: web\n    roles: [writer]\n",
+		"clients:\n  - dns_name: '[web'\n",
+		"clients:\n  - subject: web\n",
+	} {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(invalid), 0600))
+		assert.Error(t, loadClientRoles(path), invalid)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pwaas")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func() { clientRoles = nil }()
+
+	ca := newTestCA(t)
+	_, serverCert, serverKey := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "pwaas"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	spiffe, _ := url.Parse("spiffe://example.com/provisioner")
+	clientAuth := []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	web, _, _ := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "web01"}, DNSNames: []string{"web01.example.com"}, ExtKeyUsage: clientAuth})
+	provisioner, _, _ := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "provisioner"}, URIs: []*url.URL{spiffe}, ExtKeyUsage: clientAuth})
+	stranger, _, _ := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "stranger"}, ExtKeyUsage: clientAuth})
+	outsider, _, _ := newTestCA(t).issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "web01"}, DNSNames: []string{"web01.example.com"}, ExtKeyUsage: clientAuth})
+
+	files := map[string][]byte{"server.pem": serverCert, "server.key": serverKey, "ca.pem": ca.pem(), "roles.yaml": []byte(`
+roles:
+  reader: [users:read, groups:read]
+  operator: [users:read, groups:read, write, admin]
+clients:
+  - dns_name: "*.example.com"
+    roles: [reader]
+  - uri: spiffe://example.com/*
+    common_name: provisioner
+    roles: [operator]
+`)}
+	for name, contents := range files {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), contents, 0600))
+	}
+	assert.NoError(t, loadClientRoles(filepath.Join(dir, "roles.yaml")))
+	config, err := mutualTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.pem"))
+	assert.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(newServer())
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(cert *tls.Certificate, path string) (*http.Response, error) {
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			tlsConfig.Certificates = []tls.Certificate{*cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		return client.Get(server.URL + path)
+	}
+	whoamiAs := func(cert tls.Certificate) (caller Caller) {
+		res, err := get(&cert, "/v1/whoami")
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&caller))
+		return
+	}
+
+	caller := whoamiAs(web)
+	assert.True(t, caller.Authenticated)
+	assert.Equal(t, authCertificate, caller.Method)
+	assert.Equal(t, "web01", caller.Name)
+	assert.Equal(t, "CN=web01", caller.Subject)
+	assert.Equal(t, []string{"web01.example.com"}, caller.DNSNames)
+	assert.Equal(t, []string{"reader"}, caller.Roles)
+	assert.Equal(t, []string{"groups:read", "users:read"}, caller.Scopes)
+
+	caller = whoamiAs(provisioner)
+	assert.Equal(t, []string{"spiffe://example.com/provisioner"}, caller.URIs)
+	assert.Equal(t, []string{"operator"}, caller.Roles)
+
+	caller = whoamiAs(stranger)
+	assert.True(t, caller.Authenticated)
+	assert.Empty(t, caller.Roles)
+	assert.Empty(t, caller.Scopes)
+
+	for _, test := range []struct {
+		cert   tls.Certificate
+		path   string
+		status int
+	}{
+		{web, "/v1/users", http.StatusOK},
+		{web, "/v1/users/search?q=root", http.StatusForbidden},
+		{stranger, "/v1/users", http.StatusForbidden},
+		{provisioner, "/v1/admin/webhooks", http.StatusOK},
+		{web, "/v1/admin/webhooks", http.StatusForbidden},
+	} {
+		res, err := get(&test.cert, test.path)
+		assert.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, test.status, res.StatusCode, test.path)
+	}
+
+	res, err := get(&web, "/v1/users")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, "private", res.Header.Get("Cache-Control"))
+
+	// Clients without a certificate from the CA can't connect
+	_, err = get(nil, "/v1/healthcheck")
+	assert.Error(t, err)
+	_, err = get(&outsider, "/v1/healthcheck")
+	assert.Error(t, err)
+}
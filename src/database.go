@@ -1,11 +1,14 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"reflect"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 var userDB UserDB
@@ -26,8 +29,9 @@ func init() {
 // arrayGroupStorage is a simple implementation of GroupDB that keeps all Groups in a slice
 type arrayGroupStorage struct {
 	// lock will prevent us from doing a query while the DB is being updated (when files are changed)
-	lock sync.RWMutex
-	db   []Group
+	lock     sync.RWMutex
+	db       []Group
+	revision Revision
 }
 
 // SetGroupList stores Groups in the database - for simplicity, all Groups are set at once.
@@ -36,6 +40,18 @@ func (stor *arrayGroupStorage) SetGroupList(Groups ...Group) {
 	stor.lock.Lock()
 	defer stor.lock.Unlock()
 	stor.db = Groups
+	lines := make([]string, len(Groups))
+	for i, group := range Groups {
+		lines[i] = formatGroupLine(group)
+	}
+	stor.revision = nextRevision(stor.revision, lines)
+}
+
+// Revision returns the current version of the Group list
+func (stor *arrayGroupStorage) Revision() Revision {
+	stor.lock.RLock()
+	defer stor.lock.RUnlock()
+	return stor.revision
 }
 
 // QueryGroups finds Groups in the DB that match parameters given in the 'query' map
@@ -58,8 +74,9 @@ func (stor *arrayGroupStorage) Query(query map[string]interface{}) (out []Group)
 
 // arrayUserStorage is a simple implementation of UserDB that keeps all users in a slice
 type arrayUserStorage struct {
-	lock sync.RWMutex
-	db   []User
+	lock     sync.RWMutex
+	db       []User
+	revision Revision
 }
 
 // SetUserList stores users in the database. All users are set at once.
@@ -67,6 +84,18 @@ func (stor *arrayUserStorage) SetUserList(users ...User) {
 	stor.lock.Lock()
 	defer stor.lock.Unlock()
 	stor.db = users
+	lines := make([]string, len(users))
+	for i, user := range users {
+		lines[i] = formatPasswdLine(user)
+	}
+	stor.revision = nextRevision(stor.revision, lines)
+}
+
+// Revision returns the current version of the user list
+func (stor *arrayUserStorage) Revision() Revision {
+	stor.lock.RLock()
+	defer stor.lock.RUnlock()
+	return stor.revision
 }
 
 // QueryUsers finds users in the DB that match parameters given in the 'query' map
@@ -89,13 +118,17 @@ func (stor *arrayUserStorage) Query(query map[string]interface{}) (out []User) {
 func (stor *arrayUserStorage) Search(term string) (out []User) {
 	stor.lock.RLock()
 	defer stor.lock.RUnlock()
-	// nil means get all - we copy the slice so modifications don't disturb the DB
+	return rankUsers(stor.db, term)
+}
+
+// rankUsers returns the top 3 users matching a search term, most relevant first
+func rankUsers(users []User, term string) (out []User) {
 	if term == "" {
 		return
 	}
 	var results SearchResults
 	term = strings.ToLower(term)
-	for _, user := range stor.db {
+	for _, user := range users {
 		rel := matchesTerm(term, user)
 		result := SearchResult{
 			user:      user,
@@ -113,13 +146,36 @@ func (stor *arrayUserStorage) Search(term string) (out []User) {
 	return
 }
 
-// Returns true if values in query are equal to corresponding JSON values in candidate
-func matchesQuery(query map[string]interface{}, candidate interface{}) bool {
+// Hashes the rendered lines of a list. The modification time is only bumped if the hash changed,
+// so reloading an unchanged file doesn't invalidate clients' caches.
+func nextRevision(prev Revision, lines []string) Revision {
+	hash := sha256.New()
+	for _, line := range lines {
+		hash.Write([]byte(line + "\n"))
+	}
+	next := Revision{Hash: hex.EncodeToString(hash.Sum(nil)), Modified: prev.Modified}
+	if next.Hash != prev.Hash {
+		next.Modified = time.Now()
+	}
+	return next
+}
+
+// Returns the field of candidate whose JSON tag is fieldName
+func fieldByJSONName(candidate interface{}, fieldName string) (reflect.Value, bool) {
 	vals := reflect.ValueOf(candidate)
 	for i := 0; i < vals.NumField(); i++ {
-		field := vals.Field(i)
-		fieldName := vals.Type().Field(i).Tag.Get("json")
-		if queryVal, ok := query[fieldName]; ok {
+		if vals.Type().Field(i).Tag.Get("json") == fieldName {
+			return vals.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// Returns true if values in query are equal to corresponding JSON values in candidate
+func matchesQuery(query map[string]interface{}, candidate interface{}) bool {
+	for fieldName, queryVal := range query {
+		field, ok := fieldByJSONName(candidate, fieldName)
+		if ok {
 			// If we run into a slice, we make sure that all values in the query slice exist in the candidate slice
 			// TODO: make this cleaner and not O(N^2) (sort of). We just hope members lists are short for now.
 			if field.Kind() == reflect.Slice {
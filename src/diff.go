@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change, like `diff -u`
+const diffContext = 3
+
+// diffLine is a line of an edit script: ' ' unchanged, '-' removed or '+' added
+type diffLine struct {
+	Kind byte
+	Text string
+}
+
+// diffLines finds the shortest edit script from a to b, using Myers' algorithm
+func diffLines(a, b []string) []diffLine {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	// trace[d] is v[-d-1..d+1] before round d, used to walk back along the path found. Round d
+	// only reads that window, and keeping only it holds memory to O(D²) rather than O((N+M)·D).
+	var trace [][]int
+	for d := 0; d <= n+m; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrackDiff(a, b, trace)
+			}
+		}
+	}
+	return nil
+}
+
+func backtrackDiff(a, b []string, trace [][]int) []diffLine {
+	var script []diffLine
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		// trace[d] starts at k = -d-1
+		v, offset := trace[d], d+1
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x, y = x-1, y-1
+			script = append(script, diffLine{' ', a[x]})
+		}
+		if d > 0 {
+			if x == prevX {
+				script = append(script, diffLine{'+', b[prevY]})
+			} else {
+				script = append(script, diffLine{'-', a[prevX]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(script)-1; i < j; i, j = i+1, j-1 {
+		script[i], script[j] = script[j], script[i]
+	}
+	return script
+}
+
+// unifiedDiff renders the changes from a to b in unified format, or "" if there are none
+func unifiedDiff(fromFile, toFile string, a, b []string) string {
+	script := diffLines(a, b)
+	var out strings.Builder
+	// Line numbers of the next line in a and b
+	lineA, lineB := 1, 1
+	for i := 0; i < len(script); {
+		if script[i].Kind == ' ' {
+			i, lineA, lineB = i+1, lineA+1, lineB+1
+			continue
+		}
+		// Extend the hunk back over the leading context, and forward until the changes
+		// are separated by more than twice the context
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for unchanged := 0; end < len(script) && unchanged <= 2*diffContext; end++ {
+			if script[end].Kind == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+		}
+		for end > i && script[end-1].Kind == ' ' {
+			end--
+		}
+		if end += diffContext; end > len(script) {
+			end = len(script)
+		}
+
+		startA, startB := lineA-(i-start), lineB-(i-start)
+		countA, countB := 0, 0
+		var body strings.Builder
+		for _, line := range script[start:end] {
+			if line.Kind != '+' {
+				countA++
+			}
+			if line.Kind != '-' {
+				countB++
+			}
+			body.WriteString(string(line.Kind) + line.Text + "\n")
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromFile, toFile)
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(startA, countA), hunkRange(startB, countB))
+		out.WriteString(body.String())
+
+		for _, line := range script[i:end] {
+			if line.Kind != '+' {
+				lineA++
+			}
+			if line.Kind != '-' {
+				lineB++
+			}
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// hunkRange formats the line range of a hunk. Like GNU diff, an empty range
+// refers to the line before it, and a count of 1 is left out.
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start-1)
+	case 1:
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
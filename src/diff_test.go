@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	a := strings.Split("a b c d e f g h i j k l m n", " ")
+	b := strings.Split("a B c d e f g h i j k l m n o", " ")
+	// Matches `diff -u`
+	assert.Equal(t, `--- a/x
++++ b/x
+@@ -1,5 +1,5 @@
+ a
+-b
++B
+ c
+ d
+ e
+@@ -12,3 +12,4 @@
+ l
+ m
+ n
++o
+`, unifiedDiff("a/x", "b/x", a, b))
+	assert.Equal(t, "--- a\n+++ b\n@@ -0,0 +1 @@\n+x\n", unifiedDiff("a", "b", nil, []string{"x"}))
+	assert.Equal(t, "--- a\n+++ b\n@@ -1,2 +0,0 @@\n-x\n-y\n", unifiedDiff("a", "b", []string{"x", "y"}, nil))
+	assert.Equal(t, "", unifiedDiff("a", "b", a, a))
+
+	// Changes separated by up to 6 unchanged lines share a hunk
+	b = strings.Split("a B c d e f g h I j k l m n", " ")
+	assert.Equal(t, "--- a\n+++ b\n@@ -1,12 +1,12 @@\n a\n-b\n+B\n c\n d\n e\n f\n g\n h\n-i\n+I\n j\n k\n l\n",
+		unifiedDiff("a", "b", a, b))
+}
+
+func TestDiffLinesLarge(t *testing.T) {
+	// 5000 lines, with 1000 lines added between them
+	var a, b []string
+	for i := 0; i < 5000; i++ {
+		line := fmt.Sprintf("user%d:x:%d:%d::/home/user%d:/bin/sh", i, i, i, i)
+		a, b = append(a, line), append(b, line)
+		if i%5 == 0 {
+			b = append(b, fmt.Sprintf("new%d:x:%d:%d::/home/new%d:/bin/sh", i, 10000+i, 10000+i, i))
+		}
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	script := diffLines(a, b)
+	runtime.ReadMemStats(&after)
+	// Keeping a whole copy of v for each round would allocate over 100MB
+	assert.True(t, after.TotalAlloc-before.TotalAlloc < 32<<20, "allocated %d bytes", after.TotalAlloc-before.TotalAlloc)
+
+	var gotA, gotB []string
+	added := 0
+	for _, line := range script {
+		if line.Kind != '+' {
+			gotA = append(gotA, line.Text)
+		}
+		if line.Kind != '-' {
+			gotB = append(gotB, line.Text)
+		}
+		if line.Kind == '+' {
+			added++
+		}
+	}
+	assert.Equal(t, a, gotA)
+	assert.Equal(t, b, gotB)
+	assert.Equal(t, 1000, added)
+	assert.Len(t, script, 6000)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/*
+	Every change to the passwd and group files is a lineEdit. The write endpoints apply
+	them to the files on disk with editPasswdFile and editGroupFile, and POST /plan
+	applies them to copies of the lines to preview the result.
+*/
+
+// lineEdit transforms the lines of a passwd or group file
+type lineEdit func(lines []string) ([]string, error)
+
+// usersInLines parses the users out of passwd file lines
+func usersInLines(lines []string) []User {
+	users, _ := parsePasswd(strings.NewReader(strings.Join(lines, "\n")))
+	return users
+}
+
+// groupsInLines parses the groups out of group file lines
+func groupsInLines(lines []string) []Group {
+	groups, _ := parseGroups(strings.NewReader(strings.Join(lines, "\n")))
+	return groups
+}
+
+// ifMatchUser applies edit only if ifMatch matches the ETag of the user with a UID, as it
+// is in the file right now. This catches changes made through pwaas and out-of-band alike.
+// An empty ifMatch skips the check.
+func ifMatchUser(uid int, ifMatch string, edit lineEdit) lineEdit {
+	return func(lines []string) ([]string, error) {
+		if i := passwdLineIndex(lines, uid); i >= 0 && ifMatch != "" {
+			if !etagMatches(ifMatch, contentETag(lines[i])) {
+				return nil, errPreconditionFailed
+			}
+		}
+		return edit(lines)
+	}
+}
+
+// ifMatchGroup is ifMatchUser for the group with a GID
+func ifMatchGroup(gid int, ifMatch string, edit lineEdit) lineEdit {
+	return func(lines []string) ([]string, error) {
+		if i := groupLineIndex(lines, gid); i >= 0 && ifMatch != "" {
+			if !etagMatches(ifMatch, contentETag(lines[i])) {
+				return nil, errPreconditionFailed
+			}
+		}
+		return edit(lines)
+	}
+}
+
+// addUserLine appends a user, rejecting names and UIDs that are taken
+func addUserLine(user User) lineEdit {
+	return func(lines []string) ([]string, error) {
+		for _, existing := range usersInLines(lines) {
+			if existing.Name == user.Name {
+				return nil, conflict("name", fmt.Sprintf("User '%s' already exists", user.Name))
+			}
+			if existing.UID == user.UID {
+				return nil, conflict("uid", fmt.Sprintf("UID %d is already in use", user.UID))
+			}
+		}
+		return append(lines, formatPasswdLine(user)), nil
+	}
+}
+
+// updateUserLine replaces the user with a UID, keeping its password field
+func updateUserLine(uid int, user User) lineEdit {
+	return func(lines []string) ([]string, error) {
+		i := passwdLineIndex(lines, uid)
+		if i < 0 {
+			return nil, errUserNotFound
+		}
+		for _, existing := range usersInLines(lines) {
+			if existing.Name == user.Name && existing.UID != uid {
+				return nil, conflict("name", fmt.Sprintf("User '%s' already exists", user.Name))
+			}
+		}
+		lines[i] = replacePasswdLine(lines[i], user)
+		return lines, nil
+	}
+}
+
+// deleteUserLine removes the user with a UID
+func deleteUserLine(uid int) lineEdit {
+	return func(lines []string) ([]string, error) {
+		i := passwdLineIndex(lines, uid)
+		if i < 0 {
+			return nil, errUserNotFound
+		}
+		return append(lines[:i], lines[i+1:]...), nil
+	}
+}
+
+// addGroupLine appends a group, rejecting names and GIDs that are taken
+func addGroupLine(group Group) lineEdit {
+	return func(lines []string) ([]string, error) {
+		for _, existing := range groupsInLines(lines) {
+			if existing.Name == group.Name {
+				return nil, conflict("name", fmt.Sprintf("Group '%s' already exists", group.Name))
+			}
+			if existing.GID == group.GID {
+				return nil, conflict("gid", fmt.Sprintf("GID %d is already in use", group.GID))
+			}
+		}
+		return append(lines, formatGroupLine(group)), nil
+	}
+}
+
+// deleteGroupLine removes the group with a GID
+func deleteGroupLine(gid int) lineEdit {
+	return func(lines []string) ([]string, error) {
+		i := groupLineIndex(lines, gid)
+		if i < 0 {
+			return nil, errGroupNotFound
+		}
+		return append(lines[:i], lines[i+1:]...), nil
+	}
+}
+
+// editMembersLine applies edit to the members of the group with a GID, storing the updated group in result
+func editMembersLine(gid int, edit func(members []string) ([]string, error), result *Group) lineEdit {
+	return func(lines []string) ([]string, error) {
+		i := groupLineIndex(lines, gid)
+		if i < 0 {
+			return nil, errGroupNotFound
+		}
+		group := groupsInLines(lines[i : i+1])[0]
+		members, err := edit(groupMembers(group))
+		if err != nil {
+			return nil, err
+		}
+		group.Members = append([]string{}, members...)
+		lines[i] = replaceGroupLine(lines[i], group)
+		*result = group
+		return lines, nil
+	}
+}
+
+// addMember adds a name to a member list, like `gpasswd -a`
+func addMember(name string) func(members []string) ([]string, error) {
+	return func(members []string) ([]string, error) {
+		for _, existing := range members {
+			if existing == name {
+				return nil, conflict("name", fmt.Sprintf("'%s' is already a member", name))
+			}
+		}
+		return append(members, name), nil
+	}
+}
+
+// removeMember removes a name from a member list, like `gpasswd -d`
+func removeMember(name string) func(members []string) ([]string, error) {
+	return func(members []string) ([]string, error) {
+		for i, existing := range members {
+			if existing == name {
+				return append(members[:i], members[i+1:]...), nil
+			}
+		}
+		return nil, &APIError{
+			Status: http.StatusNotFound,
+			Code:   codeMemberNotFound,
+			Param:  "name",
+			Detail: fmt.Sprintf("'%s' is not a member", name),
+		}
+	}
+}
+
+// prepareGroup validates a new group and normalizes its member list.
+// Members must be among users, like gpasswd requires.
+func prepareGroup(group *Group, users []User) error {
+	if err := validateGroup(*group); err != nil {
+		return err
+	}
+	group.Members = groupMembers(*group)
+	if group.Members == nil {
+		group.Members = []string{}
+	}
+	return requireUsers(users, group.Members, "members")
+}
+
+// requireUsers checks that every name belongs to one of users
+func requireUsers(users []User, names []string, param string) error {
+	for _, name := range names {
+		found := false
+		for _, user := range users {
+			if user.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return badRequest(codeInvalidParam, param, fmt.Sprintf("User '%s' does not exist", name))
+		}
+	}
+	return nil
+}
+
+// requireNotPrimaryGroup checks that no user has gid as their primary group, like groupdel does
+func requireNotPrimaryGroup(users []User, gid int) error {
+	for _, user := range users {
+		if user.GID == gid {
+			return conflict("gid", fmt.Sprintf("Group is the primary group of user '%s'", user.Name))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// mimeProblemJSON is the content type of RFC 7807 problem details
+const mimeProblemJSON = "application/problem+json"
+
+// APIError is an error that is reported to the client as a problem+json response.
+// Code is a stable, machine-readable identifier - clients should match on it rather than Detail.
+type APIError struct {
+	Status int
+	Code   string
+	Detail string
+	// Param is the request parameter that caused the error, if any
+	Param string
+}
+
+func (e *APIError) Error() string {
+	return e.Detail
+}
+
+// Problem is the JSON body of an error response, following RFC 7807
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Code   string `json:"code"`
+	Detail string `json:"detail,omitempty"`
+	Param  string `json:"param,omitempty"`
+}
+
+// Error codes reported in Problem.Code
+const (
+	codeInvalidParam         = "invalid_param"
+	codeTooManyValues        = "too_many_values"
+	codeEmptyQuery           = "empty_query"
+	codeInvalidBody          = "invalid_body"
+	codeUnsupportedFormat    = "unsupported_format"
+	codeNotAcceptable        = "not_acceptable"
+	codeUserNotFound         = "user_not_found"
+	codeGroupNotFound        = "group_not_found"
+	codeMemberNotFound       = "member_not_found"
+	codeConflict             = "conflict"
+	codeIDsExhausted         = "ids_exhausted"
+	codeReadOnly             = "read_only"
+	codeUnauthorized         = "unauthorized"
+	codeAdminDisabled        = "admin_disabled"
+	codeInsufficientScope    = "insufficient_scope"
+	codeRestrictedByPolicy   = "restricted_by_policy"
+	codePreconditionFailed   = "precondition_failed"
+	codePreconditionRequired = "precondition_required"
+	codeNotReady             = "not_ready"
+	codeRateLimited          = "rate_limited"
+	codeTooBusy              = "too_busy"
+	codeNotFound             = "not_found"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeInternal             = "internal_error"
+)
+
+var errUserNotFound = &APIError{Status: http.StatusNotFound, Code: codeUserNotFound, Detail: "User not found"}
+var errGroupNotFound = &APIError{Status: http.StatusNotFound, Code: codeGroupNotFound, Detail: "Group not found"}
+var errPreconditionFailed = &APIError{
+	Status: http.StatusPreconditionFailed,
+	Code:   codePreconditionFailed,
+	Param:  "If-Match",
+	Detail: "The resource has changed since it was read - fetch it again and retry",
+}
+var errPreconditionRequired = &APIError{
+	Status: http.StatusPreconditionRequired,
+	Code:   codePreconditionRequired,
+	Param:  "If-Match",
+	Detail: "Send the ETag of the resource from a GET as If-Match",
+}
+var errUnauthorized = &APIError{Status: http.StatusUnauthorized, Code: codeUnauthorized, Detail: "Missing or invalid bearer token"}
+var errAdminDisabled = &APIError{Status: http.StatusForbidden, Code: codeAdminDisabled, Detail: "Admin endpoints are disabled - start pwaas with -admin-token, -api-keys or -client-roles to enable them"}
+var errRestrictedByPolicy = &APIError{Status: http.StatusForbidden, Code: codeRestrictedByPolicy, Detail: "The caller's policy hides data that this endpoint would show"}
+var errReadOnly = &APIError{Status: http.StatusForbidden, Code: codeReadOnly, Detail: "Writes are disabled - start pwaas with -writable to enable them"}
+
+// badRequest creates an APIError for an invalid request parameter
+func badRequest(code, param, detail string) *APIError {
+	return &APIError{Status: http.StatusBadRequest, Code: code, Param: param, Detail: detail}
+}
+
+// conflict creates an APIError for a write that clashes with existing data
+func conflict(param, detail string) *APIError {
+	return &APIError{Status: http.StatusConflict, Code: codeConflict, Param: param, Detail: detail}
+}
+
+// notReady creates an APIError for when the server can't serve fresh data
+func notReady(detail string) *APIError {
+	return &APIError{Status: http.StatusServiceUnavailable, Code: codeNotReady, Detail: detail}
+}
+
+// httpErrorHandler replaces echo's default error handler so that every error -
+// from handlers, the router (404, 405) or panics caught by middleware.Recover -
+// is reported in the same problem+json format.
+func httpErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+	problem := problemFor(err)
+	if problem.Status == http.StatusInternalServerError {
+		log.Println("Internal error:", err)
+	}
+	if c.Request().Method == http.MethodHead {
+		c.NoContent(problem.Status)
+		return
+	}
+	body, _ := json.Marshal(problem)
+	c.Blob(problem.Status, mimeProblemJSON, body)
+}
+
+// problemFor converts any error into a Problem
+func problemFor(err error) Problem {
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		apiErr = &APIError{Status: http.StatusInternalServerError, Code: codeInternal}
+		if httpErr, ok := err.(*echo.HTTPError); ok {
+			apiErr.Status = httpErr.Code
+			switch httpErr.Code {
+			case http.StatusNotFound:
+				apiErr.Code = codeNotFound
+			case http.StatusMethodNotAllowed:
+				apiErr.Code = codeMethodNotAllowed
+			case http.StatusInternalServerError:
+			default:
+				apiErr.Code = codeForStatus(httpErr.Code)
+				apiErr.Detail = httpErr.Error()
+				if msg, ok := httpErr.Message.(string); ok {
+					apiErr.Detail = msg
+				}
+			}
+		}
+	}
+	return Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(apiErr.Status),
+		Status: apiErr.Status,
+		Code:   apiErr.Code,
+		Detail: apiErr.Detail,
+		Param:  apiErr.Param,
+	}
+}
+
+// codeForStatus derives an error code from a status text, e.g. 415 -> "unsupported_media_type"
+func codeForStatus(status int) string {
+	return strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(strings.ToLower(http.StatusText(status)))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func parseProblem(t *testing.T, body []byte) (problem Problem) {
+	assert.NoError(t, json.Unmarshal(body, &problem))
+	return
+}
+
+func TestParseQueryParamErrors(t *testing.T) {
+	_, err := parseQueryParams(map[string][]string{"uid": {"letter"}})
+	assert.Equal(t, &APIError{Status: http.StatusBadRequest, Code: codeInvalidParam, Param: "uid", Detail: "'uid' must be an integer"}, err)
+	_, err = parseQueryParams(map[string][]string{"name": {"a", "b"}})
+	assert.Equal(t, codeTooManyValues, err.(*APIError).Code)
+	assert.Equal(t, "name", err.(*APIError).Param)
+	_, err = parseQueryParams(map[string][]string{})
+	assert.Equal(t, codeEmptyQuery, err.(*APIError).Code)
+}
+
+func TestErrorResponses(t *testing.T) {
+	passwdFilePath = passwdTestFile
+	assert.NoError(t, readPasswdFile())
+
+	code, body := mockRequest("/users/query?uid=letter", queryUsers)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, Problem{
+		Type:   "about:blank",
+		Title:  "Bad Request",
+		Status: http.StatusBadRequest,
+		Code:   codeInvalidParam,
+		Detail: "'uid' must be an integer",
+		Param:  "uid",
+	}, parseProblem(t, body))
+
+	code, body = mockParamRequest("/users/5", "/users/:uid", "uid", "5", getUserByUID)
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, codeUserNotFound, parseProblem(t, body).Code)
+}
+
+func TestErrorHandler(t *testing.T) {
+	e := echo.New()
+	e.HTTPErrorHandler = httpErrorHandler
+	e.Use(middleware.RecoverWithConfig(middleware.RecoverConfig{DisablePrintStack: true}))
+	e.GET("/users", getUsers)
+	e.GET("/panic", func(c echo.Context) error { panic("oops") })
+
+	request := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	rec := request(echo.GET, "/nowhere")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, mimeProblemJSON, rec.Header().Get(echo.HeaderContentType))
+	assert.Equal(t, codeNotFound, parseProblem(t, rec.Body.Bytes()).Code)
+
+	rec = request(echo.DELETE, "/users")
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, codeMethodNotAllowed, parseProblem(t, rec.Body.Bytes()).Code)
+
+	rec = request(echo.GET, "/panic")
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	problem := parseProblem(t, rec.Body.Bytes())
+	assert.Equal(t, codeInternal, problem.Code)
+	// Panic details aren't leaked to clients
+	assert.Empty(t, problem.Detail)
+
+	assert.Equal(t, "unsupported_media_type", codeForStatus(http.StatusUnsupportedMediaType))
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo"
+)
+
+/*
+	Every reload of the passwd or group file is compared with the data it replaces, and the
+	differences are published as change events to the /events (Server-Sent Events) and /ws
+	(WebSocket) streams. Events have increasing IDs, and the latest eventBufferSize are kept
+	so clients that reconnect with the last ID they saw get the events they missed. IDs are
+	prefixed with a random epoch per process, so that IDs from before a restart, when the
+	numbering starts again at 1, can't be mistaken for newer ones.
+*/
+
+// Change event types
+const (
+	eventUserAdded     = "user.added"
+	eventUserModified  = "user.modified"
+	eventUserRemoved   = "user.removed"
+	eventGroupAdded    = "group.added"
+	eventGroupModified = "group.modified"
+	eventGroupRemoved  = "group.removed"
+	eventMemberAdded   = "group.member_added"
+	eventMemberRemoved = "group.member_removed"
+	// eventStreamGap tells a client that events it asked to resume from are no longer
+	// buffered, so it should re-fetch the data it tracks
+	eventStreamGap = "stream.gap"
+)
+
+// eventBufferSize is how many events are kept for clients resuming with Last-Event-ID
+const eventBufferSize = 1000
+
+// subscriberBufferSize is how far a client can fall behind before it is disconnected.
+// It can reconnect with Last-Event-ID to catch up from the replay buffer.
+const subscriberBufferSize = 100
+
+// eventHeartbeat is how often idle streams send a keep-alive, so proxies don't close them
+const eventHeartbeat = 15 * time.Second
+
+// ChangeEvent is a change to a user or group. Previous is the old user or group for
+// *.modified events, and Member is set for group.member_* events.
+type ChangeEvent struct {
+	ID       string      `json:"id,omitempty"`
+	Type     string      `json:"type"`
+	Time     time.Time   `json:"time"`
+	User     *User       `json:"user,omitempty"`
+	Group    *Group      `json:"group,omitempty"`
+	Member   string      `json:"member,omitempty"`
+	Previous interface{} `json:"previous,omitempty"`
+	seq      uint64
+}
+
+// eventID is a parsed event ID, "<epoch>-<seq>". IDs from before epochs were added are
+// just the sequence number, and parse with an empty epoch.
+type eventID struct {
+	epoch string
+	seq   uint64
+}
+
+func parseEventID(id string) (parsed eventID, ok bool) {
+	seq := id
+	if i := strings.LastIndex(id, "-"); i >= 0 {
+		parsed.epoch, seq = id[:i], id[i+1:]
+	}
+	var err error
+	if parsed.seq, err = strconv.ParseUint(seq, 10, 64); err != nil {
+		return eventID{}, false
+	}
+	return parsed, true
+}
+
+// eventBroker numbers events, buffers them for replay, and fans them out to subscribers
+type eventBroker struct {
+	lock        sync.Mutex
+	epoch       string
+	lastID      uint64
+	buffer      []ChangeEvent
+	subscribers map[chan ChangeEvent]bool
+}
+
+var events = newEventBroker()
+
+func newEventBroker() *eventBroker {
+	epoch := make([]byte, 4)
+	rand.Read(epoch)
+	return &eventBroker{epoch: hex.EncodeToString(epoch), subscribers: map[chan ChangeEvent]bool{}}
+}
+
+// publish sends events to every subscriber, returning them with their IDs.
+// Subscribers that have fallen too far behind are dropped.
+func (b *eventBroker) publish(changes ...ChangeEvent) []ChangeEvent {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	for i := range changes {
+		b.lastID++
+		changes[i].seq = b.lastID
+		changes[i].ID = fmt.Sprintf("%s-%d", b.epoch, b.lastID)
+		changes[i].Time = now
+		event := changes[i]
+		b.buffer = append(b.buffer, event)
+		if len(b.buffer) > eventBufferSize {
+			b.buffer = b.buffer[len(b.buffer)-eventBufferSize:]
+		}
+		for ch := range b.subscribers {
+			select {
+			case ch <- event:
+			default:
+				delete(b.subscribers, ch)
+				close(ch)
+			}
+		}
+	}
+	return changes
+}
+
+// subscribe starts receiving events. If last is set, the events after it are returned for
+// replay, preceded by a stream.gap event if some of them are no longer buffered or last is
+// from another epoch, in which case everything buffered is replayed.
+func (b *eventBroker) subscribe(last *eventID) (replay []ChangeEvent, ch chan ChangeEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if last != nil {
+		oldest := b.lastID + 1
+		if len(b.buffer) > 0 {
+			oldest = b.buffer[0].seq
+		}
+		sameEpoch := last.epoch == b.epoch && last.seq <= b.lastID
+		if !sameEpoch || last.seq+1 < oldest {
+			replay = append(replay, ChangeEvent{Type: eventStreamGap, Time: time.Now()})
+		}
+		for _, event := range b.buffer {
+			if !sameEpoch || event.seq > last.seq {
+				replay = append(replay, event)
+			}
+		}
+	}
+	ch = make(chan ChangeEvent, subscriberBufferSize)
+	b.subscribers[ch] = true
+	return replay, ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan ChangeEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.subscribers[ch] {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// dataLock makes replacing the data and publishing the differences atomic, so that
+// concurrent reloads can't publish events against the wrong previous data
+var dataLock sync.Mutex
+
+// setUsers replaces the users in userDB, publishing what changed to the streams and webhooks. The first load isn't published.
+func setUsers(users []User) {
+	dataLock.Lock()
+	defer dataLock.Unlock()
+	initial := userDB.Revision().Hash == ""
+	old := userDB.Query(nil)
+	userDB.SetUserList(users...)
+	if !initial {
+		notifyWebhooks(events.publish(userEvents(old, users)...))
+	}
+}
+
+// setGroups replaces the groups in groupDB, publishing what changed to the streams and webhooks. The first load isn't published.
+func setGroups(groups []Group) {
+	dataLock.Lock()
+	defer dataLock.Unlock()
+	initial := groupDB.Revision().Hash == ""
+	old := groupDB.Query(nil)
+	groupDB.SetGroupList(groups...)
+	if !initial {
+		notifyWebhooks(events.publish(groupEvents(old, groups)...))
+	}
+}
+
+// userEvents diffs two lists of users, matching them by name
+func userEvents(old, new []User) (changes []ChangeEvent) {
+	oldByName := make(map[string]User, len(old))
+	for _, user := range old {
+		oldByName[user.Name] = user
+	}
+	newNames := make(map[string]bool, len(new))
+	for i := range new {
+		user := new[i]
+		newNames[user.Name] = true
+		previous, ok := oldByName[user.Name]
+		if !ok {
+			changes = append(changes, ChangeEvent{Type: eventUserAdded, User: &user})
+		} else if previous != user {
+			changes = append(changes, ChangeEvent{Type: eventUserModified, User: &user, Previous: previous})
+		}
+	}
+	for i := range old {
+		user := old[i]
+		if !newNames[user.Name] {
+			changes = append(changes, ChangeEvent{Type: eventUserRemoved, User: &user})
+		}
+	}
+	return
+}
+
+// groupEvents diffs two lists of groups, matching them by name.
+// Membership changes are reported per member rather than as group.modified.
+func groupEvents(old, new []Group) (changes []ChangeEvent) {
+	oldByName := make(map[string]Group, len(old))
+	for _, group := range old {
+		oldByName[group.Name] = group
+	}
+	newNames := make(map[string]bool, len(new))
+	for i := range new {
+		group := new[i]
+		newNames[group.Name] = true
+		previous, ok := oldByName[group.Name]
+		if !ok {
+			changes = append(changes, ChangeEvent{Type: eventGroupAdded, Group: &group})
+			continue
+		}
+		if previous.GID != group.GID {
+			changes = append(changes, ChangeEvent{Type: eventGroupModified, Group: &group, Previous: previous})
+		}
+		oldMembers := make(map[string]bool)
+		for _, member := range groupMembers(previous) {
+			oldMembers[member] = true
+		}
+		newMembers := make(map[string]bool)
+		for _, member := range groupMembers(group) {
+			newMembers[member] = true
+			if !oldMembers[member] {
+				changes = append(changes, ChangeEvent{Type: eventMemberAdded, Group: &group, Member: member})
+			}
+		}
+		for _, member := range groupMembers(previous) {
+			if !newMembers[member] {
+				changes = append(changes, ChangeEvent{Type: eventMemberRemoved, Group: &group, Member: member})
+			}
+		}
+	}
+	for i := range old {
+		group := old[i]
+		if !newNames[group.Name] {
+			changes = append(changes, ChangeEvent{Type: eventGroupRemoved, Group: &group})
+		}
+	}
+	return
+}
+
+// lastEventID reads where a client wants to resume from: the Last-Event-ID header that
+// EventSource sends when reconnecting, or ?last_event_id= for the first connection and /ws
+func lastEventID(c echo.Context) (*eventID, error) {
+	param := c.Request().Header.Get("Last-Event-ID")
+	if param == "" {
+		param = c.QueryParam("last_event_id")
+	}
+	if param == "" {
+		return nil, nil
+	}
+	id, ok := parseEventID(param)
+	if !ok {
+		return nil, badRequest(codeInvalidParam, "Last-Event-ID", "'Last-Event-ID' must be an event ID")
+	}
+	return &id, nil
+}
+
+// streamEvents sends change events as Server-Sent Events until the client disconnects
+func streamEvents(c echo.Context) error {
+	last, err := lastEventID(c)
+	if err != nil {
+		return err
+	}
+	set := callerPolicies(c)
+	replay, ch := events.subscribe(last)
+	defer events.unsubscribe(ch)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.WriteHeader(http.StatusOK)
+	write := func(event ChangeEvent) {
+		event, ok := set.redactEvent(event)
+		if !ok {
+			return
+		}
+		data, _ := json.Marshal(event)
+		if event.ID != "" {
+			fmt.Fprintf(res, "id: %s\n", event.ID)
+		}
+		fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event.Type, data)
+	}
+	for _, event := range replay {
+		write(event)
+	}
+	res.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				// Fell behind - the client reconnects and resumes from its last event
+				return nil
+			}
+			write(event)
+		case <-heartbeat.C:
+			fmt.Fprint(res, ": keep-alive\n\n")
+		case <-c.Request().Context().Done():
+			return nil
+		}
+		res.Flush()
+	}
+}
+
+var upgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 4096}
+
+// streamEventsWS sends change events as JSON WebSocket messages until the client disconnects
+func streamEventsWS(c echo.Context) error {
+	last, err := lastEventID(c)
+	if err != nil {
+		return err
+	}
+	set := callerPolicies(c)
+	// Subscribe before the handshake, so no events are missed once the client is connected
+	replay, ch := events.subscribe(last)
+	defer events.unsubscribe(ch)
+	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		// The upgrader has already responded
+		return nil
+	}
+	defer conn.Close()
+
+	// Clients don't send anything, but reading is needed to notice them closing the connection
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(event ChangeEvent) error {
+		if event, ok := set.redactEvent(event); ok {
+			return conn.WriteJSON(event)
+		}
+		return nil
+	}
+	for _, event := range replay {
+		if err := write(event); err != nil {
+			return nil
+		}
+	}
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "fell behind"))
+				return nil
+			}
+			if err := write(event); err != nil {
+				return nil
+			}
+		case <-heartbeat.C:
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return nil
+			}
+		case <-closed:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func eventTypes(changes []ChangeEvent) (types []string) {
+	for _, event := range changes {
+		types = append(types, event.Type)
+	}
+	return
+}
+
+func TestChangeEvents(t *testing.T) {
+	alice := User{Name: "alice", UID: 1000, GID: 1000, Home: "/home/alice", Shell: "/bin/sh"}
+	bob := User{Name: "bob", UID: 1001, GID: 1001, Home: "/home/bob", Shell: "/bin/sh"}
+	moved := alice
+	moved.Home = "/srv/alice"
+	changes := userEvents([]User{alice, bob}, []User{moved, {Name: "carol", UID: 1002}})
+	assert.Equal(t, []string{eventUserModified, eventUserAdded, eventUserRemoved}, eventTypes(changes))
+	assert.Equal(t, "/srv/alice", changes[0].User.Home)
+	assert.Equal(t, alice, changes[0].Previous)
+	assert.Equal(t, "carol", changes[1].User.Name)
+	assert.Equal(t, "bob", changes[2].User.Name)
+	assert.Empty(t, userEvents([]User{alice}, []User{alice}))
+
+	staff := Group{Name: "staff", GID: 50, Members: []string{"alice", "bob"}}
+	changes = groupEvents(
+		[]Group{staff, {Name: "old", GID: 60, Members: []string{""}}},
+		[]Group{{Name: "staff", GID: 51, Members: []string{"bob", "carol"}}, {Name: "new", GID: 70}},
+	)
+	assert.Equal(t, []string{eventGroupModified, eventMemberAdded, eventMemberRemoved, eventGroupAdded, eventGroupRemoved}, eventTypes(changes))
+	assert.Equal(t, "carol", changes[1].Member)
+	assert.Equal(t, "alice", changes[2].Member)
+	assert.Equal(t, staff, changes[0].Previous)
+}
+
+func TestEventReplay(t *testing.T) {
+	broker := newEventBroker()
+	for i := 0; i < eventBufferSize+10; i++ {
+		broker.publish(ChangeEvent{Type: eventUserAdded})
+	}
+	last := uint64(eventBufferSize + 10)
+
+	replay, ch := broker.subscribe(nil)
+	assert.Empty(t, replay)
+	broker.unsubscribe(ch)
+
+	replay, ch = broker.subscribe(&eventID{broker.epoch, last - 2})
+	assert.Len(t, replay, 2)
+	assert.Equal(t, fmt.Sprintf("%s-%d", broker.epoch, last-1), replay[0].ID)
+	broker.unsubscribe(ch)
+
+	replay, ch = broker.subscribe(&eventID{broker.epoch, last})
+	assert.Empty(t, replay)
+	broker.unsubscribe(ch)
+
+	// Older than the buffer
+	replay, ch = broker.subscribe(&eventID{broker.epoch, 5})
+	assert.Equal(t, eventStreamGap, replay[0].Type)
+	assert.Equal(t, broker.epoch+"-11", replay[1].ID)
+	assert.Len(t, replay, eventBufferSize+1)
+	broker.unsubscribe(ch)
+
+	// From before a restart, whether behind or ahead of the new IDs, or without an epoch
+	for _, id := range []string{"0badf00d-5", "0badf00d-" + fmt.Sprint(last+100), "5"} {
+		previous, ok := parseEventID(id)
+		assert.True(t, ok)
+		replay, ch = broker.subscribe(&previous)
+		assert.Equal(t, eventStreamGap, replay[0].Type)
+		assert.Len(t, replay, eventBufferSize+1)
+		broker.unsubscribe(ch)
+	}
+	replay, ch = broker.subscribe(nil)
+
+	// Subscribers that fall behind are disconnected
+	for i := 0; i < subscriberBufferSize+1; i++ {
+		broker.publish(ChangeEvent{Type: eventUserAdded})
+	}
+	for range ch {
+	}
+	broker.unsubscribe(ch)
+}
+
+func TestEventStreams(t *testing.T) {
+	_, cleanup := useTempPasswdFile(t)
+	defer cleanup()
+	server := httptest.NewServer(newServer())
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/v1/events?last_event_id=abc")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res.Body.Close()
+
+	res, err = http.Get(server.URL + "/v1/events")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/ws", nil)
+	assert.NoError(t, err)
+	defer ws.Close()
+
+	passwd, _ := ioutil.ReadFile(passwdFilePath)
+	passwd = append([]byte("zed:x:4242:4242::/home/zed:/bin/sh\n"), passwd...)
+	assert.NoError(t, ioutil.WriteFile(passwdFilePath, passwd, 0644))
+	assert.True(t, reloadAll().OK)
+
+	// Server-Sent Events
+	var event ChangeEvent
+	lines := bufio.NewScanner(res.Body)
+	var id string
+	for lines.Scan() {
+		line := lines.Text()
+		if strings.HasPrefix(line, "id: ") {
+			id = strings.TrimPrefix(line, "id: ")
+		}
+		if strings.HasPrefix(line, "data: ") {
+			assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+			break
+		}
+	}
+	assert.Equal(t, eventUserAdded, event.Type)
+	assert.Equal(t, "zed", event.User.Name)
+	assert.Equal(t, event.ID, id)
+
+	// WebSocket
+	var wsEvent ChangeEvent
+	assert.NoError(t, ws.ReadJSON(&wsEvent))
+	assert.Equal(t, event.ID, wsEvent.ID)
+	assert.Equal(t, "zed", wsEvent.User.Name)
+
+	// Resuming replays what was missed
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/v1/events", nil)
+	previous, ok := parseEventID(event.ID)
+	assert.True(t, ok)
+	req.Header.Set("Last-Event-ID", fmt.Sprintf("%s-%d", previous.epoch, previous.seq-1))
+	resumed, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resumed.Body.Close()
+	lines = bufio.NewScanner(resumed.Body)
+	assert.True(t, lines.Scan())
+	assert.Equal(t, "id: "+id, lines.Text())
+}
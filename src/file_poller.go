@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Ways of detecting changes to the passwd and group files, set with -watch
+const (
+	watchInotify = "inotify"
+	watchPoll    = "poll"
+	watchBoth    = "both"
+)
+
+// watchMode is how file changes are detected. inotify doesn't work on NFS and some
+// overlay filesystems, where poll mode checks the files every pollInterval instead.
+var watchMode = watchInotify
+var pollInterval = 5 * time.Second
+
+// WatchStatus reports which change detection mechanisms are running
+type WatchStatus struct {
+	Mode         string   `json:"mode"`
+	Active       []string `json:"active"`
+	PollInterval string   `json:"poll_interval,omitempty"`
+}
+
+// activeWatchers tracks the mechanisms that are running, which can differ from watchMode
+// if inotify fails to start
+var activeWatchers = map[string]bool{}
+var activeWatchersLock sync.Mutex
+
+func setWatcherActive(mechanism string, active bool) {
+	activeWatchersLock.Lock()
+	defer activeWatchersLock.Unlock()
+	activeWatchers[mechanism] = active
+}
+
+func watchStatus() WatchStatus {
+	activeWatchersLock.Lock()
+	defer activeWatchersLock.Unlock()
+	status := WatchStatus{Mode: watchMode, Active: []string{}}
+	for mechanism, active := range activeWatchers {
+		if active {
+			status.Active = append(status.Active, mechanism)
+		}
+	}
+	sort.Strings(status.Active)
+	if activeWatchers[watchPoll] {
+		status.PollInterval = pollInterval.String()
+	}
+	return status
+}
+
+// fileSignature is what poll mode compares to notice a file has changed. The content hash
+// catches changes that keep the mtime and size, like restoring a backup with `cp -p`.
+type fileSignature struct {
+	modTime time.Time
+	size    int64
+	hash    [sha256.Size]byte
+}
+
+func signatureOf(path string) (fileSignature, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileSignature{}, err
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fileSignature{}, err
+	}
+	return fileSignature{modTime: info.ModTime(), size: info.Size(), hash: sha256.Sum256(contents)}, nil
+}
+
+// pollFiles checks the passwd and group files every interval, reloading them when their
+// signature changes, until done is closed. Files that can't be read keep their last good data.
+func pollFiles(interval time.Duration, done <-chan struct{}) {
+	setWatcherActive(watchPoll, true)
+	defer setWatcherActive(watchPoll, false)
+	paths := []string{passwdFilePath, groupFilePath}
+	last := make(map[string]fileSignature)
+	for _, path := range paths {
+		last[path], _ = signatureOf(path)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			for _, path := range paths {
+				signature, err := signatureOf(path)
+				if err != nil || signature == last[path] {
+					continue
+				}
+				last[path] = signature
+				reloadFile(path)
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPollFiles(t *testing.T) {
+	_, cleanup := useTempPasswdFile(t)
+	defer cleanup()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		pollFiles(10*time.Millisecond, done)
+		close(stopped)
+	}()
+	defer func() {
+		close(done)
+		<-stopped
+	}()
+	eventually(t, func() bool { return watchStatus().PollInterval != "" }, "the poller to start")
+
+	assert.NoError(t, ioutil.WriteFile(passwdFilePath, []byte("alice:x:1000:1000::/home/alice:/bin/sh\n"), 0644))
+	eventually(t, hasUser("alice"), "a write")
+
+	// Changes that keep the mtime and size are caught by the content hash
+	info, _ := os.Stat(passwdFilePath)
+	assert.NoError(t, ioutil.WriteFile(passwdFilePath, []byte("carol:x:1000:1000::/home/carol:/bin/sh\n"), 0644))
+	assert.NoError(t, os.Chtimes(passwdFilePath, info.ModTime(), info.ModTime()))
+	eventually(t, hasUser("carol"), "a change with the same mtime and size")
+
+	// A missing file keeps the last good data
+	assert.NoError(t, os.Remove(groupFilePath))
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, groupDB.Query(map[string]interface{}{"gid": 24}), 1)
+	assert.NoError(t, ioutil.WriteFile(groupFilePath, []byte("staff:x:50:carol\n"), 0644))
+	eventually(t, func() bool { return len(groupDB.Query(map[string]interface{}{"gid": 50})) == 1 }, "the recreated group file")
+}
+
+func TestWatchStatus(t *testing.T) {
+	defer func() { activeWatchers = map[string]bool{} }()
+	watchMode = watchBoth
+	defer func() { watchMode = watchInotify }()
+	// inotify failed to start, so only polling is running
+	activeWatchers = map[string]bool{watchInotify: false, watchPoll: true}
+
+	rec := serveWrite(newServer(), echo.GET, "/v1/status", "")
+	var status Status
+	assert.NoError(t, json.NewDecoder(strings.NewReader(rec.Body.String())).Decode(&status))
+	assert.Equal(t, WatchStatus{Mode: "both", Active: []string{"poll"}, PollInterval: "5s"}, status.Watch)
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
@@ -10,69 +16,151 @@ import (
 var passwdFilePath string
 var groupFilePath string
 
-func readPasswdFile() error {
+func readPasswdFile() (err error) {
+	hash := sha256.New()
+	var info os.FileInfo
+	defer func() { recordLoad(passwdFilePath, hash, info, err) }()
 	passwdFile, err := os.Open(passwdFilePath)
 	if err != nil {
 		return err
 	}
 	defer passwdFile.Close()
-	users, err := parsePasswd(passwdFile)
+	if info, err = passwdFile.Stat(); err != nil {
+		return err
+	}
+	var contents bytes.Buffer
+	users, err := parsePasswd(io.TeeReader(passwdFile, io.MultiWriter(hash, &contents)))
 	if err != nil {
 		return err
 	}
-	userDB.SetUserList(users...)
+	setLineETags(&lineETags.users, splitLines(contents.Bytes()), func(line string) (int, bool) {
+		users, err := parsePasswd(strings.NewReader(line))
+		if err != nil || len(users) != 1 {
+			return 0, false
+		}
+		return users[0].UID, true
+	})
+	setUsers(users)
 	log.Println("Parsed passwd file:", passwdFilePath)
 	return nil
 }
 
-func readGroupFile() error {
+func readGroupFile() (err error) {
+	hash := sha256.New()
+	var info os.FileInfo
+	defer func() { recordLoad(groupFilePath, hash, info, err) }()
 	groupsFile, err := os.Open(groupFilePath)
 	if err != nil {
 		return err
 	}
 	defer groupsFile.Close()
-	users, err := parseGroups(groupsFile)
+	if info, err = groupsFile.Stat(); err != nil {
+		return err
+	}
+	var contents bytes.Buffer
+	users, err := parseGroups(io.TeeReader(groupsFile, io.MultiWriter(hash, &contents)))
 	if err != nil {
 		return err
 	}
-	groupDB.SetGroupList(users...)
+	setLineETags(&lineETags.groups, splitLines(contents.Bytes()), func(line string) (int, bool) {
+		groups, err := parseGroups(strings.NewReader(line))
+		if err != nil || len(groups) != 1 {
+			return 0, false
+		}
+		return groups[0].GID, true
+	})
+	setGroups(users)
 	log.Println("Parsed groups file:", groupFilePath)
 	return nil
 }
 
-// watchFiles uses fsnotify filesystem change notifications to keep an eye on the
-//   passwd and groups files, and update the database if they change.
+// setLineETags replaces the ETags of a file's lines, keeping the first line of each ID
+// like passwdLineIndex and groupLineIndex
+func setLineETags(etags *map[int]string, lines []string, idOf func(line string) (int, bool)) {
+	byID := make(map[int]string)
+	for _, line := range lines {
+		if id, ok := idOf(line); ok {
+			if _, seen := byID[id]; !seen {
+				byID[id] = contentETag(line)
+			}
+		}
+	}
+	lineETags.Lock()
+	defer lineETags.Unlock()
+	*etags = byID
+}
+
+// watchDebounce is how long the watcher waits for a burst of events to settle before reloading.
+// Editors and tools like vipw write a temp file, rename it into place and chmod it, which
+// would otherwise reload the file several times, sometimes while it is missing.
+const watchDebounce = 100 * time.Millisecond
+
+// watchFiles keeps an eye on the passwd and groups files in the background, and updates
+// the database if they change. Depending on watchMode it uses fsnotify filesystem change
+// notifications, polling, or both. If fsnotify can't be started, it falls back to polling.
 // Errors are non-fatal as the watch functionality isn't critical.
 func watchFiles() {
+	poll := watchMode != watchInotify
+	if watchMode != watchPoll {
+		watcher, err := newFileWatcher()
+		if err != nil {
+			log.Println("Failed to initialize file watcher, polling instead:", err)
+			poll = true
+		} else {
+			setWatcherActive(watchInotify, true)
+			go func() {
+				defer watcher.Close()
+				defer setWatcherActive(watchInotify, false)
+				handleFileEvents(watcher)
+			}()
+		}
+	}
+	if poll {
+		go pollFiles(pollInterval, nil)
+	}
+}
+
+// newFileWatcher watches the directories containing the passwd and group files rather than
+// the files themselves. A watch on a file follows its inode, so it goes quiet when the file is
+// replaced by a rename, while a directory watch sees the new file under the same name.
+func newFileWatcher() (*fsnotify.Watcher, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		log.Println("Failed to initialize file watcher", err)
+		return nil, err
 	}
-	watcher.Add(passwdFilePath)
-	watcher.Add(groupFilePath)
-	defer watcher.Close()
+	for _, dir := range []string{filepath.Dir(passwdFilePath), filepath.Dir(groupFilePath)} {
+		if err = watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	return watcher, nil
+}
+
+// handleFileEvents reloads the passwd and group files when they are written, created,
+// renamed, removed or have their permissions changed, until the watcher is closed
+func handleFileEvents(watcher *fsnotify.Watcher) {
+	pending := make(map[string]bool)
+	var settled <-chan time.Time
 	for {
 		select {
 		case event, ok := <-watcher.Events:
 			if !ok {
 				return
 			}
-			if event.Op&fsnotify.Write == fsnotify.Write {
-				if event.Name == passwdFilePath {
-					log.Println("Passwd file modified. Reloading...")
-					err := readPasswdFile()
-					if err != nil {
-						log.Println("Passwd file parsing error: ", err)
-					}
-				}
-				if event.Name == groupFilePath {
-					log.Println("Groups file modified. Reloading...")
-					err := readGroupFile()
-					if err != nil {
-						log.Println("Groups file parsing error: ", err)
-					}
-				}
+			name := filepath.Clean(event.Name)
+			if name != passwdFilePath && name != groupFilePath {
+				// Other files in the same directory, like the passwd- backup
+				continue
 			}
+			pending[name] = true
+			settled = time.After(watchDebounce)
+		case <-settled:
+			for name := range pending {
+				reloadFile(name)
+			}
+			pending = make(map[string]bool)
+			settled = nil
 		case err, ok := <-watcher.Errors:
 			if !ok {
 				return
@@ -81,3 +169,20 @@ func watchFiles() {
 		}
 	}
 }
+
+// reloadFile re-reads the passwd or group file at path. If it can't be read, for example
+// because it was removed, the last good data is kept until it is recreated.
+func reloadFile(path string) {
+	if path == passwdFilePath {
+		log.Println("Passwd file modified. Reloading...")
+		if err := readPasswdFile(); err != nil {
+			log.Println("Passwd file parsing error: ", err)
+		}
+	}
+	if path == groupFilePath {
+		log.Println("Groups file modified. Reloading...")
+		if err := readGroupFile(); err != nil {
+			log.Println("Groups file parsing error: ", err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startWatcher watches temp copies of the test files, returning a function that stops it
+func startWatcher(t *testing.T) (dir string, stop func()) {
+	dir, cleanup := useTempPasswdFile(t)
+	watcher, err := newFileWatcher()
+	if !assert.NoError(t, err) {
+		cleanup()
+		t.FailNow()
+	}
+	done := make(chan struct{})
+	go func() {
+		handleFileEvents(watcher)
+		close(done)
+	}()
+	return dir, func() {
+		watcher.Close()
+		<-done
+		cleanup()
+	}
+}
+
+// eventually polls cond until it is true or a few seconds have passed
+func eventually(t *testing.T, cond func() bool, msg string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func hasUser(name string) func() bool {
+	return func() bool { return len(userDB.Query(map[string]interface{}{"name": name})) == 1 }
+}
+
+// replaceFile writes contents to a temp file and renames it over path, like vipw and most editors do
+func replaceFile(t *testing.T, path, contents string) {
+	tmp := filepath.Join(filepath.Dir(path), ".edit.tmp")
+	assert.NoError(t, ioutil.WriteFile(tmp, []byte(contents), 0644))
+	assert.NoError(t, os.Rename(tmp, path))
+}
+
+func TestWatchRenameReplace(t *testing.T) {
+	_, stop := startWatcher(t)
+	defer stop()
+
+	replaceFile(t, passwdFilePath, "alice:x:1000:1000::/home/alice:/bin/sh\n")
+	eventually(t, hasUser("alice"), "the first rename")
+	assert.Len(t, userDB.Query(nil), 1)
+
+	// The watch survives the inode changing, so later replacements are seen too
+	replaceFile(t, passwdFilePath, "carol:x:1001:1001::/home/carol:/bin/sh\n")
+	eventually(t, hasUser("carol"), "the second rename")
+
+	replaceFile(t, groupFilePath, "staff:x:50:carol\n")
+	eventually(t, func() bool { return len(groupDB.Query(map[string]interface{}{"gid": 50})) == 1 }, "the group file rename")
+
+	// Writes in place still work
+	assert.NoError(t, ioutil.WriteFile(passwdFilePath, []byte("dave:x:1002:1002::/home/dave:/bin/sh\n"), 0644))
+	eventually(t, hasUser("dave"), "the write")
+}
+
+func TestWatchRemoveRecreate(t *testing.T) {
+	_, stop := startWatcher(t)
+	defer stop()
+
+	// The last good data is kept while the file is missing
+	assert.NoError(t, os.Remove(passwdFilePath))
+	time.Sleep(3 * watchDebounce)
+	assert.True(t, hasUser("bob")())
+
+	assert.NoError(t, ioutil.WriteFile(passwdFilePath, []byte("erin:x:1003:1003::/home/erin:/bin/sh\n"), 0644))
+	eventually(t, hasUser("erin"), "the recreated file")
+}
+
+func TestWatchDebounce(t *testing.T) {
+	_, stop := startWatcher(t)
+	defer stop()
+	rev := userDB.Revision()
+
+	// A burst of writes is reloaded once it settles
+	f, err := os.OpenFile(passwdFilePath, os.O_WRONLY|os.O_TRUNC, 0644)
+	assert.NoError(t, err)
+	f.WriteString("frank:x:1004:1004:")
+	time.Sleep(watchDebounce / 4)
+	f.WriteString(":/home/frank:/bin/sh\n")
+	f.Close()
+	eventually(t, hasUser("frank"), "the burst of writes")
+	assert.NotEqual(t, rev.Hash, userDB.Revision().Hash)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// writable enables the endpoints that modify the passwd and group files
+var writable bool
+
+// lockTimeout is how long to wait for .pwd.lock, the same as lckpwdf(3)
+const lockTimeout = 15 * time.Second
+
+// writeLock serializes writes within pwaas - fcntl locks don't exclude other threads of the same process
+var writeLock sync.Mutex
+
+/*
+	Writes follow the same protocol as the shadow-utils tools (useradd, vipw, ...):
+
+	1. Take an fcntl write lock on .pwd.lock in the same directory as the passwd file
+	2. Read the current file from disk, so edits made outside pwaas aren't lost
+	3. Write the new contents to a temp file in the same directory
+	4. Save the current file as a backup with a '-' suffix, e.g. passwd-
+	5. Rename the temp file into place, so readers never see a partial file
+
+	Edits are done on the lines of the file, so comments and formatting are preserved.
+*/
+
+// lockAccountFiles takes the .pwd.lock lock, retrying until lockTimeout.
+// The returned function releases it.
+func lockAccountFiles(dir string) (func(), error) {
+	writeLock.Lock()
+	lockFile, err := os.OpenFile(filepath.Join(dir, ".pwd.lock"), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		writeLock.Unlock()
+		return nil, err
+	}
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0, Start: 0, Len: 0}
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		err = syscall.FcntlFlock(lockFile.Fd(), syscall.F_SETLK, &lock)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			lockFile.Close()
+			writeLock.Unlock()
+			return nil, errors.New("timed out waiting for .pwd.lock")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return func() {
+		// Closing the file releases the fcntl lock
+		lockFile.Close()
+		writeLock.Unlock()
+	}, nil
+}
+
+// editAccountFile applies edit to the lines of the file at path and atomically writes the result.
+// validate is called with the new contents, and the file is left untouched if it returns an error.
+func editAccountFile(path string, edit lineEdit, validate func(contents []byte) error) error {
+	unlock, err := lockAccountFiles(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines, err := edit(splitLines(current))
+	if err != nil {
+		return err
+	}
+	contents := joinLines(lines)
+	if err = validate(contents); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, current, contents)
+}
+
+// splitLines splits file contents into lines, without the trailing newline
+func splitLines(contents []byte) []string {
+	if len(contents) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+}
+
+// joinLines is the inverse of splitLines
+func joinLines(lines []string) []byte {
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// writeFileAtomic replaces the file at path with contents, keeping previous as a backup at path + "-"
+func writeFileAtomic(path string, previous, contents []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	// Clean up the temp file if anything goes wrong - this fails harmlessly after the rename
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path+"-", previous, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// editPasswdFile edits the lines of the passwd file, then reloads userDB
+func editPasswdFile(edit lineEdit) error {
+	err := editAccountFile(passwdFilePath, edit, func(contents []byte) error {
+		_, err := parsePasswd(bytes.NewReader(contents))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// Refresh right away rather than waiting for the file watcher
+	return readPasswdFile()
+}
+
+// passwdLineIndex finds the line of the first user matching a UID, or -1
+func passwdLineIndex(lines []string, uid int) int {
+	for i, line := range lines {
+		users, err := parsePasswd(strings.NewReader(line))
+		if err == nil && len(users) == 1 && users[0].UID == uid {
+			return i
+		}
+	}
+	return -1
+}
+
+// replacePasswdLine renders user in place of an existing passwd line, keeping its password field
+func replacePasswdLine(old string, user User) string {
+	return keepPasswordField(old, formatPasswdLine(user))
+}
+
+// editGroupFile edits the lines of the group file, then reloads groupDB
+func editGroupFile(edit lineEdit) error {
+	err := editAccountFile(groupFilePath, edit, func(contents []byte) error {
+		_, err := parseGroups(bytes.NewReader(contents))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// Refresh right away so /users/:uid/groups reflects the change without waiting for the file watcher
+	return readGroupFile()
+}
+
+// groupLineIndex finds the line of the first group matching a GID, or -1
+func groupLineIndex(lines []string, gid int) int {
+	for i, line := range lines {
+		groups, err := parseGroups(strings.NewReader(line))
+		if err == nil && len(groups) == 1 && groups[0].GID == gid {
+			return i
+		}
+	}
+	return -1
+}
+
+// replaceGroupLine renders group in place of an existing group line, keeping its password field
+func replaceGroupLine(old string, group Group) string {
+	return keepPasswordField(old, formatGroupLine(group))
+}
+
+// keepPasswordField copies the second (password) field of old into line
+func keepPasswordField(old, line string) string {
+	fields := strings.Split(line, ":")
+	if oldFields := strings.Split(old, ":"); len(oldFields) > 1 {
+		fields[1] = oldFields[1]
+	}
+	return strings.Join(fields, ":")
+}
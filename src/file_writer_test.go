@@ -0,0 +1,265 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+// useTempPasswdFile copies the test passwd and group files into a temp dir and points pwaas at it
+func useTempPasswdFile(t *testing.T) (dir string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "pwaas")
+	assert.NoError(t, err)
+	oldPasswdPath, oldGroupPath := passwdFilePath, groupFilePath
+	text, err := ioutil.ReadFile(passwdTestFile)
+	assert.NoError(t, err)
+	passwdFilePath = filepath.Join(dir, "passwd")
+	assert.NoError(t, ioutil.WriteFile(passwdFilePath, text, 0644))
+	assert.NoError(t, readPasswdFile())
+	text, err = ioutil.ReadFile(groupTestFile)
+	assert.NoError(t, err)
+	groupFilePath = filepath.Join(dir, "group")
+	assert.NoError(t, ioutil.WriteFile(groupFilePath, text, 0644))
+	assert.NoError(t, readGroupFile())
+	return dir, func() {
+		os.RemoveAll(dir)
+		passwdFilePath, groupFilePath = oldPasswdPath, oldGroupPath
+	}
+}
+
+var groupTestFile = "../sample_files/group.test.txt"
+
+func serveWrite(e *echo.Echo, method, path, body string) *httptest.ResponseRecorder {
+	return serveWriteIfMatch(e, method, path, body, "")
+}
+
+func serveWriteIfMatch(e *echo.Echo, method, path, body, ifMatch string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestWritesDisabled(t *testing.T) {
+	_, cleanup := useTempPasswdFile(t)
+	defer cleanup()
+	writable = false
+	rec := serveWrite(newServer(), echo.DELETE, "/v1/users/78", "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Len(t, userDB.Query(nil), 2)
+}
+
+func TestUserWrites(t *testing.T) {
+	dir, cleanup := useTempPasswdFile(t)
+	defer cleanup()
+	writable = true
+	defer func() { writable = false }()
+	e := newServer()
+	original, _ := ioutil.ReadFile(passwdFilePath)
+
+	rec := serveWrite(e, echo.POST, "/v1/users", `{"name": "alice", "uid": 1000, "gid": 100, "comment": "Alice", "home": "/home/alice", "shell": "/bin/zsh"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	alice := User{Name: "alice", UID: 1000, GID: 100, Comment: "Alice", Home: "/home/alice", Shell: "/bin/zsh"}
+	// userDB is refreshed without waiting for the file watcher
+	assert.Equal(t, []User{alice}, userDB.Query(map[string]interface{}{"uid": 1000}))
+
+	// Comments are preserved, the previous file is backed up, and no temp files are left behind
+	text, _ := ioutil.ReadFile(passwdFilePath)
+	assert.True(t, strings.HasPrefix(string(text), "# this is a comment\n"))
+	assert.True(t, strings.HasSuffix(string(text), "\nalice:x:1000:100:Alice:/home/alice:/bin/zsh\n"))
+	backup, _ := ioutil.ReadFile(passwdFilePath + "-")
+	assert.Equal(t, original, backup)
+	files, _ := ioutil.ReadDir(dir)
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	assert.ElementsMatch(t, []string{".pwd.lock", "group", "passwd", "passwd-"}, names)
+
+	rec = serveWrite(e, echo.POST, "/v1/users", `{"name": "alice", "uid": 1001, "gid": 100, "home": "/home/alice"}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = serveWrite(e, echo.POST, "/v1/users", `{"name": "alice2", "uid": 78, "gid": 100, "home": "/home/alice"}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = serveWrite(e, echo.POST, "/v1/users", `{"name": "bad:name", "uid": 1001, "gid": 100, "home": "/home/x"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "name", parseProblem(t, rec.Body.Bytes()).Param)
+	rec = serveWrite(e, echo.POST, "/v1/users", `{"name": "carol", "uid": 1001, "gid": 100, "home": "relative"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	// Missing IDs aren't taken as 0, which is root's
+	rec = serveWrite(e, echo.POST, "/v1/users", `{"name": "carol", "gid": 100, "home": "/home/carol"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "uid", parseProblem(t, rec.Body.Bytes()).Param)
+	rec = serveWrite(e, echo.POST, "/v1/users", `{"name": "carol", "uid": 1001, "home": "/home/carol"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "gid", parseProblem(t, rec.Body.Bytes()).Param)
+
+	// Updates keep the existing password field
+	rec = serveWriteIfMatch(e, echo.PUT, "/v1/users/78", `{"name": "bob", "gid": 78, "comment": "Robert Jones", "home": "/home/bob", "shell": "/bin/sh"}`, "*")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	text, _ = ioutil.ReadFile(passwdFilePath)
+	assert.Contains(t, string(text), "\nbob:*:78:78:Robert Jones:/home/bob:/bin/sh\n")
+	assert.Equal(t, "Robert Jones", userDB.Query(map[string]interface{}{"uid": 78})[0].Comment)
+
+	rec = serveWriteIfMatch(e, echo.PUT, "/v1/users/78", `{"name": "root", "gid": 78, "home": "/home/bob"}`, "*")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = serveWriteIfMatch(e, echo.PUT, "/v1/users/78", `{"name": "bob", "uid": 79, "gid": 78, "home": "/home/bob"}`, "*")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = serveWriteIfMatch(e, echo.PUT, "/v1/users/5", `{"name": "nobody", "gid": 5, "home": "/"}`, "*")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = serveWriteIfMatch(e, echo.PUT, "/v1/users/78", `{"name": "bob", "home": "/home/bob"}`, "*")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "gid", parseProblem(t, rec.Body.Bytes()).Param)
+
+	rec = serveWriteIfMatch(e, echo.DELETE, "/v1/users/1000", "", "*")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Len(t, userDB.Query(map[string]interface{}{"uid": 1000}), 0)
+	rec = serveWriteIfMatch(e, echo.DELETE, "/v1/users/1000", "", "*")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestGroupWrites(t *testing.T) {
+	_, cleanup := useTempPasswdFile(t)
+	defer cleanup()
+	writable = true
+	defer func() { writable = false }()
+	e := newServer()
+
+	rec := serveWrite(e, echo.POST, "/v1/groups", `{"name": "staff", "gid": 50}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.JSONEq(t, `{"name": "staff", "gid": 50, "members": []}`, rec.Body.String())
+	rec = serveWrite(e, echo.POST, "/v1/groups", `{"name": "staff", "gid": 51}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = serveWrite(e, echo.POST, "/v1/groups", `{"name": "wheel", "gid": 24}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = serveWrite(e, echo.POST, "/v1/groups", `{"name": "wheel", "gid": 10, "members": ["nobody"]}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = serveWrite(e, echo.POST, "/v1/groups", `{"name": "nogid"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, mimeProblemJSON, rec.Header().Get(echo.HeaderContentType))
+	assert.Equal(t, "gid", parseProblem(t, rec.Body.Bytes()).Param)
+	groupText, _ := ioutil.ReadFile(groupFilePath)
+	assert.NotContains(t, string(groupText), "nogid")
+
+	// Membership changes show up in /users/:uid/groups right away
+	rec = serveWrite(e, echo.POST, "/v1/groups/50/members", `{"name": "bob"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"name": "staff", "gid": 50, "members": ["bob"]}`, rec.Body.String())
+	rec = serveWrite(e, echo.GET, "/v1/users/78/groups", "")
+	assert.Contains(t, rec.Body.String(), `"staff"`)
+	rec = serveWrite(e, echo.POST, "/v1/groups/50/members", `{"name": "bob"}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = serveWrite(e, echo.POST, "/v1/groups/50/members", `{"name": "nobody"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = serveWrite(e, echo.POST, "/v1/groups/5/members", `{"name": "bob"}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// The password field and other members are untouched
+	rec = serveWriteIfMatch(e, echo.DELETE, "/v1/groups/24/members/bob", "", "*")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	text, _ := ioutil.ReadFile(groupFilePath)
+	assert.Contains(t, string(text), "\nmygroup:*:24:root\n")
+	assert.True(t, strings.HasPrefix(string(text), "# this is a comment\n"))
+	rec = serveWrite(e, echo.GET, "/v1/users/78/groups", "")
+	assert.NotContains(t, rec.Body.String(), `"mygroup"`)
+	rec = serveWriteIfMatch(e, echo.DELETE, "/v1/groups/24/members/bob", "", "*")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, codeMemberNotFound, parseProblem(t, rec.Body.Bytes()).Code)
+
+	rec = serveWriteIfMatch(e, echo.DELETE, "/v1/groups/50", "", "*")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Len(t, groupDB.Query(map[string]interface{}{"gid": 50}), 0)
+	rec = serveWriteIfMatch(e, echo.DELETE, "/v1/groups/50", "", "*")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// Groups that are still someone's primary group can't be deleted
+	assert.NoError(t, editGroupFile(func(lines []string) ([]string, error) {
+		return append(lines, "bob:x:78:"), nil
+	}))
+	rec = serveWriteIfMatch(e, echo.DELETE, "/v1/groups/78", "", "*")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+}
+
+func TestIfMatch(t *testing.T) {
+	_, cleanup := useTempPasswdFile(t)
+	defer cleanup()
+	writable = true
+	defer func() { writable = false }()
+	e := newServer()
+
+	rec := serveWrite(e, echo.GET, "/v1/users/78", "")
+	etag := rec.Header().Get("ETag")
+	assert.Equal(t, userETag(testUser1), etag)
+	// The ETag is per user, so changes to other users don't invalidate it
+	rec = serveWrite(e, echo.GET, "/v1/users/0", "")
+	assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+	req := httptest.NewRequest(echo.GET, "/v1/users/78", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	rec = serveWrite(e, echo.PATCH, "/v1/users/78", `{"shell": "/bin/zsh"}`)
+	assert.Equal(t, http.StatusPreconditionRequired, rec.Code)
+	assert.Equal(t, codePreconditionRequired, parseProblem(t, rec.Body.Bytes()).Code)
+	rec = serveWriteIfMatch(e, echo.PATCH, "/v1/users/78", `{"shell": "/bin/zsh"}`, `W/`+etag)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+
+	rec = serveWriteIfMatch(e, echo.PATCH, "/v1/users/78", `{"shell": "/bin/zsh"}`, etag)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"name": "bob", "uid": 78, "gid": 78, "comment": "Bob Jones", "home": "/home/bob", "shell": "/bin/zsh"}`, rec.Body.String())
+	newETag := rec.Header().Get("ETag")
+	assert.NotEqual(t, etag, newETag)
+
+	// A second write with the old ETag is stale
+	rec = serveWriteIfMatch(e, echo.PUT, "/v1/users/78", `{"name": "bob", "gid": 78, "home": "/home/bob"}`, etag)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	assert.Equal(t, codePreconditionFailed, parseProblem(t, rec.Body.Bytes()).Code)
+
+	// So are edits made outside pwaas, even before the file watcher has seen them
+	text, _ := ioutil.ReadFile(passwdFilePath)
+	text = []byte(strings.Replace(string(text), "/bin/zsh", "/bin/ksh", 1))
+	assert.NoError(t, ioutil.WriteFile(passwdFilePath, text, 0644))
+	rec = serveWriteIfMatch(e, echo.DELETE, "/v1/users/78", "", `"stale", `+newETag)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	assert.NoError(t, readPasswdFile())
+	rec = serveWrite(e, echo.GET, "/v1/users/78", "")
+	rec = serveWriteIfMatch(e, echo.DELETE, "/v1/users/78", "", `"stale", `+rec.Header().Get("ETag"))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	// The ETag is of the whole line, so locking an account changes it
+	etag = serveWrite(e, echo.GET, "/v1/users/0", "").Header().Get("ETag")
+	text, _ = ioutil.ReadFile(passwdFilePath)
+	text = []byte(strings.Replace(string(text), "root:*:", "root:!:", 1))
+	assert.NoError(t, ioutil.WriteFile(passwdFilePath, text, 0644))
+	rec = serveWriteIfMatch(e, echo.PATCH, "/v1/users/0", `{"shell": "/bin/sh"}`, etag)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	assert.NoError(t, readPasswdFile())
+	rec = serveWrite(e, echo.GET, "/v1/users/0", "")
+	assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+	rec = serveWriteIfMatch(e, echo.PATCH, "/v1/users/0", `{"shell": "/bin/sh"}`, rec.Header().Get("ETag"))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	text, _ = ioutil.ReadFile(passwdFilePath)
+	assert.Contains(t, string(text), "root:!:0:0:Root User:/root:/bin/sh")
+	assert.Equal(t, contentETag("root:!:0:0:Root User:/root:/bin/sh"), rec.Header().Get("ETag"))
+
+	// Groups work the same way
+	rec = serveWrite(e, echo.GET, "/v1/groups/24", "")
+	etag = rec.Header().Get("ETag")
+	rec = serveWriteIfMatch(e, echo.POST, "/v1/groups/24/members", `{"name": "root"}`, etag)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = serveWriteIfMatch(e, echo.DELETE, "/v1/groups/24/members/root", "", etag)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = serveWriteIfMatch(e, echo.DELETE, "/v1/groups/24", "", etag)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswdRoundTrip(t *testing.T) {
+	assert.Equal(t, "bob:x:78:78:Bob Jones:/home/bob:/bin/bash", formatPasswdLine(testUser1))
+	for _, file := range []string{"../sample_files/passwd.txt", passwdTestFile} {
+		text, err := ioutil.ReadFile(file)
+		assert.NoError(t, err)
+		users, err := parsePasswd(bytes.NewReader(text))
+		assert.NoError(t, err)
+
+		var lines []string
+		for _, user := range users {
+			lines = append(lines, formatPasswdLine(user))
+		}
+		reparsed, err := parsePasswd(strings.NewReader(strings.Join(lines, "\n")))
+		assert.NoError(t, err)
+		assert.Equal(t, users, reparsed)
+	}
+}
+
+func TestGroupRoundTrip(t *testing.T) {
+	assert.Equal(t, "mygroup:x:24:bob,root", formatGroupLine(testGroup1))
+	for _, file := range []string{"../sample_files/group.txt", "../sample_files/group.test.txt"} {
+		text, err := ioutil.ReadFile(file)
+		assert.NoError(t, err)
+		groups, err := parseGroups(bytes.NewReader(text))
+		assert.NoError(t, err)
+
+		var lines []string
+		for _, group := range groups {
+			lines = append(lines, formatGroupLine(group))
+		}
+		reparsed, err := parseGroups(strings.NewReader(strings.Join(lines, "\n")))
+		assert.NoError(t, err)
+		assert.Equal(t, groups, reparsed)
+	}
+}
+
+func TestGetentEndpoints(t *testing.T) {
+	passwdFilePath = passwdTestFile
+	assert.NoError(t, readPasswdFile())
+	groupFilePath = "../sample_files/group.test.txt"
+	assert.NoError(t, readGroupFile())
+
+	code, body := mockRequest("/getent/passwd", getentPasswd)
+	assert.Equal(t, http.StatusOK, code)
+	users, err := parsePasswd(bytes.NewReader(body))
+	assert.NoError(t, err)
+	assert.Equal(t, []User{testUser1, testUser2}, users)
+
+	code, body = mockParamRequest("/getent/passwd/root", "/getent/passwd/:key", "key", "root", getentPasswd)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "root:x:0:0:Root User:/root:/bin/bash\n", string(body))
+	code, body = mockParamRequest("/getent/passwd/78", "/getent/passwd/:key", "key", "78", getentPasswd)
+	assert.Equal(t, http.StatusOK, code)
+	users, _ = parsePasswd(bytes.NewReader(body))
+	assert.Equal(t, []User{testUser1}, users)
+	code, _ = mockParamRequest("/getent/passwd/nobody", "/getent/passwd/:key", "key", "nobody", getentPasswd)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, body = mockRequest("/getent/group", getentGroup)
+	assert.Equal(t, http.StatusOK, code)
+	groups, err := parseGroups(bytes.NewReader(body))
+	assert.NoError(t, err)
+	assert.Equal(t, []Group{testGroup1, testGroup2}, groups)
+
+	code, body = mockParamRequest("/getent/group/80", "/getent/group/:key", "key", "80", getentGroup)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "admin:x:80:root\n", string(body))
+	code, _ = mockParamRequest("/getent/group/wheel", "/getent/group/:key", "key", "wheel", getentGroup)
+	assert.Equal(t, http.StatusNotFound, code)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync/atomic"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// maxQueryDepth limits how deeply GraphQL selections can nest, so joins like
+// user -> groups -> users -> groups -> ... can't be used to make huge responses.
+// Introspection (__schema, __type) nests deeper in the queries tools send, with
+// type { ofType { ofType ... } } chains, so it has a limit of its own.
+const (
+	maxQueryDepth         = 8
+	maxIntrospectionDepth = 15
+)
+
+// maxQueryRows limits the users and groups a GraphQL query can resolve in total. Depth alone
+// doesn't limit the cost, since each join multiplies the number of rows.
+const maxQueryRows = 10000
+
+var gqlSchema graphql.Schema
+
+var gqlUserType, gqlGroupType *graphql.Object
+
+func init() {
+	gqlUserType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "User",
+		Description: "A UNIX user in a passwd file",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			fields := gqlFieldsOf(User{})
+			fields["primaryGroup"] = &graphql.Field{
+				Type:        gqlGroupType,
+				Description: "The group matching the user's GID",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					user := p.Source.(User)
+					return spendRows(p, func() interface{} {
+						return firstGroup(gqlPolicies(p).findGroups(map[string]interface{}{"gid": user.GID}))
+					})
+				},
+			}
+			fields["groups"] = &graphql.Field{
+				Type:        graphql.NewList(gqlGroupType),
+				Description: "Groups that list the user as a member",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					user := p.Source.(User)
+					return spendRows(p, func() interface{} {
+						return gqlPolicies(p).findGroups(map[string]interface{}{"members": []string{user.Name}})
+					})
+				},
+			}
+			return fields
+		}),
+	})
+
+	gqlGroupType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Group",
+		Description: "A UNIX group in a group file",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			fields := gqlFieldsOf(Group{})
+			fields["users"] = &graphql.Field{
+				Type:        graphql.NewList(gqlUserType),
+				Description: "Users listed as members of the group",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					group := p.Source.(Group)
+					return spendRows(p, func() interface{} {
+						users := []User{}
+						for _, member := range groupMembers(group) {
+							users = append(users, userDB.Query(map[string]interface{}{"name": member})...)
+						}
+						return gqlPolicies(p).users(users)
+					})
+				},
+			}
+			fields["primaryUsers"] = &graphql.Field{
+				Type:        graphql.NewList(gqlUserType),
+				Description: "Users whose primary GID is this group",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					group := p.Source.(Group)
+					return spendRows(p, func() interface{} { return gqlPolicies(p).findUsers(map[string]interface{}{"gid": group.GID}) })
+				},
+			}
+			return fields
+		}),
+	})
+
+	userArgs := gqlArgsOf(User{})
+	userArgs["search"] = &graphql.ArgumentConfig{
+		Type:        graphql.String,
+		Description: "Text search across all user fields, like /users/search",
+	}
+	groupArgs := gqlArgsOf(Group{})
+	// Groups are filtered by 'member' like in /groups/query
+	delete(groupArgs, "members")
+	groupArgs["member"] = &graphql.ArgumentConfig{
+		Type:        graphql.NewList(graphql.String),
+		Description: "Only return groups containing all of these members",
+	}
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"users": &graphql.Field{
+				Type:    graphql.NewList(gqlUserType),
+				Args:    userArgs,
+				Resolve: resolveUsers,
+			},
+			"user": &graphql.Field{
+				Type: gqlUserType,
+				Args: graphql.FieldConfigArgument{
+					"uid": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return spendRows(p, func() interface{} { return firstUser(gqlPolicies(p).findUsers(p.Args)) })
+				},
+			},
+			"groups": &graphql.Field{
+				Type:    graphql.NewList(gqlGroupType),
+				Args:    groupArgs,
+				Resolve: resolveGroups,
+			},
+			"group": &graphql.Field{
+				Type: gqlGroupType,
+				Args: graphql.FieldConfigArgument{
+					"gid": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return spendRows(p, func() interface{} { return firstGroup(gqlPolicies(p).findGroups(p.Args)) })
+				},
+			},
+		},
+	})
+
+	var err error
+	gqlSchema, err = graphql.NewSchema(graphql.SchemaConfig{Query: query})
+	if err != nil {
+		log.Fatal("Invalid GraphQL schema: ", err)
+	}
+}
+
+// resolveUsers maps the 'users' field arguments onto userDB.Search or userDB.Query
+func resolveUsers(p graphql.ResolveParams) (interface{}, error) {
+	if term, ok := p.Args["search"].(string); ok {
+		return spendRows(p, func() interface{} { return gqlPolicies(p).searchUsers(term) })
+	}
+	if len(p.Args) == 0 {
+		return spendRows(p, func() interface{} { return gqlPolicies(p).findUsers(nil) })
+	}
+	return spendRows(p, func() interface{} { return gqlPolicies(p).findUsers(p.Args) })
+}
+
+// resolveGroups maps the 'groups' field arguments onto groupDB.Query
+func resolveGroups(p graphql.ResolveParams) (interface{}, error) {
+	if len(p.Args) == 0 {
+		return spendRows(p, func() interface{} { return gqlPolicies(p).findGroups(nil) })
+	}
+	query := make(map[string]interface{})
+	for k, v := range p.Args {
+		if k == "member" {
+			var members []string
+			for _, member := range v.([]interface{}) {
+				members = append(members, fmt.Sprint(member))
+			}
+			query["members"] = members
+		} else {
+			query[k] = v
+		}
+	}
+	return spendRows(p, func() interface{} { return gqlPolicies(p).findGroups(query) })
+}
+
+type rowBudgetContextKey struct{}
+
+// spendRows resolves the users or groups of a field and charges them to the query's
+// maxQueryRows budget. Once it's used up, fields fail without being resolved, and runGraphQL
+// reports the one error rather than partial data.
+func spendRows(p graphql.ResolveParams, resolve func() interface{}) (interface{}, error) {
+	remaining, ok := p.Context.Value(rowBudgetContextKey{}).(*int64)
+	if !ok {
+		return resolve(), nil
+	}
+	if atomic.LoadInt64(remaining) < 0 {
+		return nil, errTooManyRows
+	}
+	rows := resolve()
+	n := 0
+	if rows != nil {
+		n = 1
+	}
+	if value := reflect.ValueOf(rows); value.Kind() == reflect.Slice {
+		n = value.Len()
+	}
+	if atomic.AddInt64(remaining, -int64(n)) < 0 {
+		return nil, errTooManyRows
+	}
+	return rows, nil
+}
+
+// firstUser is the user a single user field resolves to, or nil
+func firstUser(users []User) interface{} {
+	if len(users) == 0 {
+		return nil
+	}
+	return users[0]
+}
+
+// firstGroup is firstUser for groups
+func firstGroup(groups []Group) interface{} {
+	if len(groups) == 0 {
+		return nil
+	}
+	return groups[0]
+}
+
+var errTooManyRows = fmt.Errorf("query resolves more than %d users and groups - use fewer joins, or filters that match less", maxQueryRows)
+
+// gqlTypeOf returns the GraphQL type matching a struct field's Go type
+func gqlTypeOf(t reflect.Type) graphql.Output {
+	switch t.Kind() {
+	case reflect.Int:
+		return graphql.Int
+	case reflect.Slice:
+		return graphql.NewList(gqlTypeOf(t.Elem()))
+	default:
+		return graphql.String
+	}
+}
+
+// gqlFieldsOf generates GraphQL fields for each JSON-tagged field of model
+func gqlFieldsOf(model interface{}) graphql.Fields {
+	fields := graphql.Fields{}
+	modelType := reflect.TypeOf(model)
+	for i := 0; i < modelType.NumField(); i++ {
+		name := modelType.Field(i).Tag.Get("json")
+		fields[name] = &graphql.Field{
+			Type: graphql.NewNonNull(gqlTypeOf(modelType.Field(i).Type)),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				field, _ := fieldByJSONName(p.Source, name)
+				return field.Interface(), nil
+			},
+		}
+	}
+	return fields
+}
+
+// gqlArgsOf generates optional filter arguments for each JSON-tagged field of model
+func gqlArgsOf(model interface{}) graphql.FieldConfigArgument {
+	args := graphql.FieldConfigArgument{}
+	modelType := reflect.TypeOf(model)
+	for i := 0; i < modelType.NumField(); i++ {
+		name := modelType.Field(i).Tag.Get("json")
+		args[name] = &graphql.ArgumentConfig{Type: gqlTypeOf(modelType.Field(i).Type)}
+	}
+	return args
+}
+
+// GraphQLRequest is the body of a GraphQL POST request
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// runGraphQL checks the depth of a GraphQL request and executes it against gqlSchema, within
+// the maxQueryRows budget, showing only what the policies allow
+func runGraphQL(req GraphQLRequest, set policySet) *graphql.Result {
+	doc, err := parser.Parse(parser.ParseParams{Source: req.Query})
+	if err != nil {
+		// Let graphql.Do report the syntax error in the standard format
+		return graphql.Do(graphql.Params{Schema: gqlSchema, RequestString: req.Query})
+	}
+	depth, introspection := queryDepth(doc)
+	if depth > maxQueryDepth {
+		return &graphql.Result{Errors: gqlErrors(fmt.Errorf(
+			"query depth %d exceeds the maximum of %d", depth, maxQueryDepth))}
+	}
+	if introspection > maxIntrospectionDepth {
+		return &graphql.Result{Errors: gqlErrors(fmt.Errorf(
+			"introspection depth %d exceeds the maximum of %d", introspection, maxIntrospectionDepth))}
+	}
+	budget := int64(maxQueryRows)
+	result := graphql.Do(graphql.Params{
+		Schema:         gqlSchema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        context.WithValue(withPolicies(context.Background(), set), rowBudgetContextKey{}, &budget),
+	})
+	if atomic.LoadInt64(&budget) < 0 {
+		return &graphql.Result{Errors: gqlErrors(errTooManyRows)}
+	}
+	return result
+}
+
+// queryDepth returns the deepest level of field nesting in any operation of doc, apart from
+// introspection, and the deepest level of nesting that goes through introspection fields
+func queryDepth(doc *ast.Document) (max, maxIntrospection int) {
+	fragments := make(map[string]*ast.FragmentDefinition)
+	for _, def := range doc.Definitions {
+		if frag, ok := def.(*ast.FragmentDefinition); ok {
+			fragments[frag.Name.Value] = frag
+		}
+	}
+	for _, def := range doc.Definitions {
+		if op, ok := def.(*ast.OperationDefinition); ok {
+			depth, introspection := selectionDepth(op.SelectionSet, fragments, map[string]bool{})
+			if depth > max {
+				max = depth
+			}
+			if introspection > maxIntrospection {
+				maxIntrospection = introspection
+			}
+		}
+	}
+	return
+}
+
+// selectionDepth walks a selection set, following fragment spreads once each to avoid cycles
+func selectionDepth(set *ast.SelectionSet, fragments map[string]*ast.FragmentDefinition, seen map[string]bool) (max, maxIntrospection int) {
+	if set == nil {
+		return 0, 0
+	}
+	for _, selection := range set.Selections {
+		depth, introspection := 0, 0
+		switch sel := selection.(type) {
+		case *ast.Field:
+			depth, introspection = selectionDepth(sel.SelectionSet, fragments, seen)
+			if strings.HasPrefix(sel.Name.Value, "__") {
+				// Everything below an introspection field counts as introspection
+				depth, introspection = 0, 1+maxInt(depth, introspection)
+			} else {
+				depth++
+				if introspection > 0 {
+					introspection++
+				}
+			}
+		case *ast.InlineFragment:
+			depth, introspection = selectionDepth(sel.SelectionSet, fragments, seen)
+		case *ast.FragmentSpread:
+			frag, ok := fragments[sel.Name.Value]
+			if !ok || seen[sel.Name.Value] {
+				continue
+			}
+			seen[sel.Name.Value] = true
+			depth, introspection = selectionDepth(frag.SelectionSet, fragments, seen)
+			delete(seen, sel.Name.Value)
+		}
+		max, maxIntrospection = maxInt(max, depth), maxInt(maxIntrospection, introspection)
+	}
+	return
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// gqlErrors wraps an error in the GraphQL response error format
+func gqlErrors(err error) []gqlerrors.FormattedError {
+	return []gqlerrors.FormattedError{gqlerrors.FormatError(err)}
+}
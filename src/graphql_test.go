@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGraphQL(t *testing.T) {
+	passwdFilePath = passwdTestFile
+	assert.NoError(t, readPasswdFile())
+	groupFilePath = "../sample_files/group.test.txt"
+	assert.NoError(t, readGroupFile())
+
+	result := runGraphQL(GraphQLRequest{Query: `{ user(uid: 78) { name primaryGroup { name } groups { name gid users { name } } } }`}, nil)
+	assert.Empty(t, result.Errors)
+	out, _ := json.Marshal(result.Data)
+	assert.JSONEq(t, `{"user": {"name": "bob", "primaryGroup": null,
+		"groups": [{"name": "mygroup", "gid": 24, "users": [{"name": "bob"}, {"name": "root"}]}]}}`, string(out))
+
+	result = runGraphQL(GraphQLRequest{Query: `{ users(shell: "/bin/bash", uid: 0) { name } groups(member: ["root"]) { name } }`}, nil)
+	assert.Empty(t, result.Errors)
+	out, _ = json.Marshal(result.Data)
+	assert.JSONEq(t, `{"users": [{"name": "root"}], "groups": [{"name": "mygroup"}, {"name": "admin"}]}`, string(out))
+
+	result = runGraphQL(GraphQLRequest{Query: `{ users(search: "bob") { uid } }`}, nil)
+	out, _ = json.Marshal(result.Data)
+	assert.JSONEq(t, `{"users": [{"uid": 78}]}`, string(out))
+
+	result = runGraphQL(GraphQLRequest{Query: `{ __schema { types { name fields { name type { name ofType { name ofType { name } } } } } } }`}, nil)
+	assert.Empty(t, result.Errors)
+
+	// Too deep: user > groups > users > groups > users > groups > users > groups > name
+	result = runGraphQL(GraphQLRequest{Query: `fragment g on Group { users { groups { name } } }
+		{ user(uid: 0) { groups { users { groups { users { groups { ...g } } } } } } }`}, nil)
+	assert.Len(t, result.Errors, 1)
+	assert.Contains(t, result.Errors[0].Message, "depth")
+
+	// Introspection has a limit of its own, deep enough for the queries tools send
+	typeRef := "kind name"
+	for i := 0; i < 7; i++ {
+		typeRef = "kind name ofType { " + typeRef + " }"
+	}
+	result = runGraphQL(GraphQLRequest{Query: `{ __schema { types { fields { args { type { ` + typeRef + ` } } } } } }`}, nil)
+	assert.Empty(t, result.Errors)
+	for i := 0; i < 10; i++ {
+		typeRef = "ofType { " + typeRef + " }"
+	}
+	result = runGraphQL(GraphQLRequest{Query: `fragment t on __Type { ofType { ` + typeRef + ` } }
+		{ user(uid: 0) { __typename } __type(name: "User") { ...t } }`}, nil)
+	assert.Len(t, result.Errors, 1)
+	assert.Contains(t, result.Errors[0].Message, "introspection depth")
+}
+
+func TestGraphQLRowBudget(t *testing.T) {
+	// 50 users in one group: each users > groups > users join multiplies the rows by 50
+	users := make([]User, 50)
+	names := make([]string, len(users))
+	for i := range users {
+		users[i] = User{Name: fmt.Sprintf("user%d", i), UID: 1000 + i, GID: 100, Home: "/home"}
+		names[i] = users[i].Name
+	}
+	userDB.SetUserList(users...)
+	groupDB.SetGroupList(Group{Name: "staff", GID: 100, Members: names})
+	defer func() {
+		assert.NoError(t, readPasswdFile())
+		assert.NoError(t, readGroupFile())
+	}()
+
+	result := runGraphQL(GraphQLRequest{Query: `{ users { groups { users { name } } } }`}, nil)
+	assert.Empty(t, result.Errors)
+	start := time.Now()
+	result = runGraphQL(GraphQLRequest{Query: `{ users { groups { users { groups { users { name } } } } } }`}, nil)
+	assert.Len(t, result.Errors, 1)
+	assert.Contains(t, result.Errors[0].Message, "more than 10000 users and groups")
+	assert.Nil(t, result.Data)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestGraphQLEndpoint(t *testing.T) {
+	passwdFilePath = passwdTestFile
+	assert.NoError(t, readPasswdFile())
+
+	code, body := mockBodyRequest(echo.POST, "/graphql", `{"query": "query U($uid: Int!) { user(uid: $uid) { home } }", "variables": {"uid": 0}}`, graphqlHandler)
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"data": {"user": {"home": "/root"}}}`, string(body))
+
+	code, body = mockRequest("/graphql?query=%7Buser(uid%3A78)%7Bname%7D%7D", graphqlHandler)
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"data": {"user": {"name": "bob"}}}`, string(body))
+
+	code, _ = mockRequest("/graphql", graphqlHandler)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
 
+	"github.com/labstack/echo"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -139,3 +141,53 @@ func TestGroupEndpoints(t *testing.T) {
 	code, body = mockRequest("/groups/query?gid=letter", queryGroups)
 	assert.Equal(t, http.StatusBadRequest, code)
 }
+
+func TestBatchGroups(t *testing.T) {
+	groupFilePath = "../sample_files/group.test.txt"
+	assert.NoError(t, readGroupFile())
+
+	code, body := mockBodyRequest(echo.POST, "/groups/batch", `{"keys": [24, "admin", "nogroup"]}`, batchGroups)
+	assert.Equal(t, http.StatusOK, code)
+	var results map[string]GroupBatchResult
+	assert.NoError(t, json.Unmarshal(body, &results))
+	assert.Equal(t, testGroup1, *results["24"].Group)
+	assert.Equal(t, testGroup2, *results["admin"].Group)
+	assert.False(t, results["nogroup"].Found)
+}
+
+func TestUserIdentity(t *testing.T) {
+	primary := Group{Name: "bob", GID: 78, Members: []string{""}}
+	ident := buildIdentity(testUser1, []Group{testGroup1, primary, testGroup2})
+	assert.Equal(t, "uid=78(bob) gid=78(bob) groups=78(bob),24(mygroup)\n", ident.String())
+
+	// The primary group isn't repeated when the user is also listed as a member
+	ident = buildIdentity(testUser2, []Group{testGroup1, testGroup2, {Name: "wheel", GID: 0, Members: []string{"root"}}})
+	assert.Equal(t, "uid=0(root) gid=0(wheel) groups=0(wheel),24(mygroup),80(admin)\n", ident.String())
+
+	// GIDs without a group have no name, like `id`
+	ident = buildIdentity(User{Name: "ghost", UID: 900, GID: 901}, nil)
+	assert.Equal(t, "uid=900(ghost) gid=901 groups=901\n", ident.String())
+
+	groupFilePath = "../sample_files/group.test.txt"
+	assert.NoError(t, readGroupFile())
+	passwdFilePath = "../sample_files/passwd.test.txt"
+	assert.NoError(t, readPasswdFile())
+
+	code, body := mockParamRequest("/users/78/id", "/users/:uid/id", "uid", "78", getUserIdentity)
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"uid": 78, "name": "bob", "group": {"gid": 78},
+		"groups": [{"gid": 78}, {"gid": 24, "name": "mygroup"}]}`, string(body))
+
+	e := echo.New()
+	req := httptest.NewRequest(echo.GET, "/users/0/id", nil)
+	req.Header.Set(echo.HeaderAccept, echo.MIMETextPlain)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("uid")
+	c.SetParamValues("0")
+	assert.NoError(t, getUserIdentity(c))
+	assert.Equal(t, "uid=0(root) gid=0 groups=0,24(mygroup),80(admin)\n", rec.Body.String())
+
+	code, _ = mockParamRequest("/users/5/id", "/users/:uid/id", "uid", "5", getUserIdentity)
+	assert.Equal(t, http.StatusNotFound, code)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// IdentityGroup is a GID and, if the group exists, its name
+type IdentityGroup struct {
+	GID  int    `json:"gid"`
+	Name string `json:"name,omitempty"`
+}
+
+// Identity is the information printed by the coreutils `id` command for a user
+type Identity struct {
+	UID    int             `json:"uid"`
+	Name   string          `json:"name"`
+	Group  IdentityGroup   `json:"group"`
+	Groups []IdentityGroup `json:"groups"`
+}
+
+// buildIdentity collects a user's primary group and supplementary groups.
+// Like `id`, the primary group is listed first and each GID appears only once.
+func buildIdentity(user User, groups []Group) Identity {
+	primary := IdentityGroup{GID: user.GID}
+	for _, group := range groups {
+		if group.GID == user.GID {
+			primary.Name = group.Name
+			break
+		}
+	}
+	ident := Identity{
+		UID:    user.UID,
+		Name:   user.Name,
+		Group:  primary,
+		Groups: []IdentityGroup{primary},
+	}
+	seen := map[int]bool{user.GID: true}
+	for _, group := range groups {
+		if seen[group.GID] {
+			continue
+		}
+		for _, member := range group.Members {
+			if member == user.Name {
+				ident.Groups = append(ident.Groups, IdentityGroup{GID: group.GID, Name: group.Name})
+				seen[group.GID] = true
+				break
+			}
+		}
+	}
+	return ident
+}
+
+func (g IdentityGroup) String() string {
+	if g.Name == "" {
+		return fmt.Sprint(g.GID)
+	}
+	return fmt.Sprintf("%d(%s)", g.GID, g.Name)
+}
+
+// String formats the identity exactly like `id <user>`, e.g.
+// uid=78(bob) gid=78(bob) groups=78(bob),24(mygroup)
+func (ident Identity) String() string {
+	groups := make([]string, len(ident.Groups))
+	for i, group := range ident.Groups {
+		groups[i] = group.String()
+	}
+	return fmt.Sprintf("uid=%d(%s) gid=%s groups=%s\n",
+		ident.UID, ident.Name, ident.Group, strings.Join(groups, ","))
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// idRanges are the ranges IDs are allocated from, keyed like "uid/regular".
+// The defaults are those of shadow-utils, overridden by login.defs and then the -*-range flags.
+var idRanges = map[string]IDRange{
+	"uid/system":  {Start: 101, End: 999},
+	"uid/regular": {Start: 1000, End: 60000},
+	"gid/system":  {Start: 101, End: 999},
+	"gid/regular": {Start: 1000, End: 60000},
+}
+
+// loginDefsKeys maps login.defs settings to the idRanges they set
+var loginDefsKeys = map[string]string{
+	"SYS_UID_MIN": "uid/system",
+	"SYS_UID_MAX": "uid/system",
+	"UID_MIN":     "uid/regular",
+	"UID_MAX":     "uid/regular",
+	"SYS_GID_MIN": "gid/system",
+	"SYS_GID_MAX": "gid/system",
+	"GID_MIN":     "gid/regular",
+	"GID_MAX":     "gid/regular",
+}
+
+// maxReservationTTL caps how long an allocated ID can be held back from other callers
+const maxReservationTTL = time.Hour
+
+// reservations maps IDs handed out by allocateID to when their reservation expires.
+// UIDs and GIDs share one set, the same way allocation skips IDs used as either.
+var reservations = map[int]time.Time{}
+var reservationsLock sync.Mutex
+
+// IDAllocation is the result of allocating a free ID
+type IDAllocation struct {
+	Kind          string     `json:"kind"`
+	Class         string     `json:"class"`
+	ID            int        `json:"id"`
+	ReservedUntil *time.Time `json:"reserved_until,omitempty"`
+}
+
+// FreeIDs lists the unused IDs in a range
+type FreeIDs struct {
+	Kind  string    `json:"kind"`
+	Class string    `json:"class"`
+	Range IDRange   `json:"range"`
+	Free  []IDRange `json:"free"`
+}
+
+// loadIDRanges applies the settings in a login.defs file to idRanges. A missing file is not an error.
+func loadIDRanges(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	settings, err := parseLoginDefs(file)
+	if err != nil {
+		return err
+	}
+	for key, rangeKey := range loginDefsKeys {
+		value, ok := settings[key]
+		if !ok {
+			continue
+		}
+		r := idRanges[rangeKey]
+		if strings.HasSuffix(key, "_MIN") {
+			r.Start = value
+		} else {
+			r.End = value
+		}
+		idRanges[rangeKey] = r
+	}
+	log.Println("Read ID ranges from", path)
+	return nil
+}
+
+// parseLoginDefs reads the numeric ID settings from a login.defs file, which has "KEY value" lines
+func parseLoginDefs(reader io.Reader) (map[string]int, error) {
+	settings := make(map[string]int)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if _, ok := loginDefsKeys[fields[0]]; !ok {
+			continue
+		}
+		value, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("login.defs parse error: %s is not a number", fields[0])
+		}
+		settings[fields[0]] = value
+	}
+	return settings, scanner.Err()
+}
+
+// parseIDRange parses an inclusive range like "1000-60000"
+func parseIDRange(s string) (IDRange, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return IDRange{}, errors.New("ID range must look like <min>-<max>")
+	}
+	start, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return IDRange{}, err
+	}
+	end, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return IDRange{}, err
+	}
+	if start < 0 || end < start {
+		return IDRange{}, errors.New("ID range must be non-negative and in order")
+	}
+	return IDRange{Start: start, End: end}, nil
+}
+
+// usedIDs collects every UID and GID in either database, and every unexpired reservation.
+// Expired reservations are dropped. reservationsLock must be held.
+func usedIDs(now time.Time) map[int]bool {
+	used := make(map[int]bool)
+	for _, user := range userDB.Query(nil) {
+		used[user.UID] = true
+		used[user.GID] = true
+	}
+	for _, group := range groupDB.Query(nil) {
+		used[group.GID] = true
+	}
+	for id, until := range reservations {
+		if now.After(until) {
+			delete(reservations, id)
+		} else {
+			used[id] = true
+		}
+	}
+	return used
+}
+
+// allocateFreeID finds the lowest free ID in a range and, if ttl is set, reserves it
+func allocateFreeID(r IDRange, ttl time.Duration, now time.Time) (id int, until time.Time, ok bool) {
+	reservationsLock.Lock()
+	defer reservationsLock.Unlock()
+	used := usedIDs(now)
+	for id = r.Start; id <= r.End; id++ {
+		if !used[id] {
+			if ttl > 0 {
+				until = now.Add(ttl)
+				reservations[id] = until
+			}
+			return id, until, true
+		}
+	}
+	return 0, until, false
+}
+
+// freeRanges lists the gaps between used IDs within a range
+func freeRanges(r IDRange, now time.Time) []IDRange {
+	reservationsLock.Lock()
+	used := usedIDs(now)
+	reservationsLock.Unlock()
+	var inRange []int
+	for id := range used {
+		if id >= r.Start && id <= r.End {
+			inRange = append(inRange, id)
+		}
+	}
+	sort.Ints(inRange)
+	free := []IDRange{}
+	next := r.Start
+	for _, id := range inRange {
+		if id > next {
+			free = append(free, IDRange{Start: next, End: id - 1})
+		}
+		next = id + 1
+	}
+	if next <= r.End {
+		free = append(free, IDRange{Start: next, End: r.End})
+	}
+	return free
+}
+
+// parseIDClass reads the ?kind= and ?class= params, returning the key of the range in idRanges
+func parseIDClass(c echo.Context) (kind, class string, err error) {
+	kind = c.QueryParam("kind")
+	if kind != "uid" && kind != "gid" {
+		return "", "", badRequest(codeInvalidParam, "kind", "'kind' must be 'uid' or 'gid'")
+	}
+	class = c.QueryParam("class")
+	if class == "" {
+		class = "regular"
+	}
+	if class != "system" && class != "regular" {
+		return "", "", badRequest(codeInvalidParam, "class", "'class' must be 'system' or 'regular'")
+	}
+	return kind, class, nil
+}
+
+// allocateID returns the next free UID or GID. With ?ttl=<seconds>, the ID is reserved
+// so that concurrent callers don't get the same one while it is being provisioned.
+func allocateID(c echo.Context) error {
+	// Free IDs show which IDs hidden users and groups have
+	if callerPolicies(c).hidesRows() {
+		return errRestrictedByPolicy
+	}
+	kind, class, err := parseIDClass(c)
+	if err != nil {
+		return err
+	}
+	var ttl time.Duration
+	if param := c.QueryParam("ttl"); param != "" {
+		seconds, err := strconv.Atoi(param)
+		if err != nil || seconds < 0 || seconds > int(maxReservationTTL/time.Second) {
+			return badRequest(codeInvalidParam, "ttl", fmt.Sprintf("'ttl' must be a number of seconds up to %d", int(maxReservationTTL.Seconds())))
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	id, until, ok := allocateFreeID(idRanges[kind+"/"+class], ttl, time.Now())
+	if !ok {
+		return &APIError{Status: http.StatusConflict, Code: codeIDsExhausted, Detail: fmt.Sprintf("No free %s %ss are left", class, kind)}
+	}
+	allocation := IDAllocation{Kind: kind, Class: class, ID: id}
+	if ttl > 0 {
+		allocation.ReservedUntil = &until
+	}
+	return c.JSON(http.StatusOK, allocation)
+}
+
+// getFreeIDs lists the unused, unreserved IDs in a range
+func getFreeIDs(c echo.Context) error {
+	if callerPolicies(c).hidesRows() {
+		return errRestrictedByPolicy
+	}
+	kind, class, err := parseIDClass(c)
+	if err != nil {
+		return err
+	}
+	r := idRanges[kind+"/"+class]
+	return c.JSON(http.StatusOK, FreeIDs{Kind: kind, Class: class, Range: r, Free: freeRanges(r, time.Now())})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLoginDefs(t *testing.T) {
+	settings, err := parseLoginDefs(strings.NewReader("# comment\nUID_MIN\t\t\t  500\nUID_MAX 59999\nUMASK 022\n#GID_MIN 10\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"UID_MIN": 500, "UID_MAX": 59999}, settings)
+	_, err = parseLoginDefs(strings.NewReader("GID_MAX lots\n"))
+	assert.Error(t, err)
+
+	r, err := parseIDRange("1000-2000")
+	assert.NoError(t, err)
+	assert.Equal(t, IDRange{Start: 1000, End: 2000}, r)
+	for _, bad := range []string{"1000", "2000-1000", "a-b", "-1-5"} {
+		_, err = parseIDRange(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestAllocateID(t *testing.T) {
+	passwdFilePath = passwdTestFile
+	groupFilePath = groupTestFile
+	readPasswdFile()
+	readGroupFile()
+	saved := idRanges["uid/regular"]
+	defer func() {
+		idRanges["uid/regular"] = saved
+		reservations = map[int]time.Time{}
+	}()
+	// Users have IDs 0 and 78, and groups have GIDs 24 and 80
+	idRanges["uid/regular"] = IDRange{Start: 75, End: 80}
+	e := newServer()
+
+	allocate := func(query string) (int, IDAllocation) {
+		rec := serveWrite(e, echo.POST, "/v1/ids/allocate?"+query, "")
+		var allocation IDAllocation
+		json.Unmarshal(rec.Body.Bytes(), &allocation)
+		return rec.Code, allocation
+	}
+	// Reserved IDs aren't handed out again
+	code, allocation := allocate("kind=uid&ttl=60")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 75, allocation.ID)
+	assert.NotNil(t, allocation.ReservedUntil)
+	_, allocation = allocate("kind=uid&class=regular&ttl=60")
+	assert.Equal(t, 76, allocation.ID)
+	_, allocation = allocate("kind=uid")
+	assert.Equal(t, 77, allocation.ID)
+	assert.Nil(t, allocation.ReservedUntil)
+	_, allocation = allocate("kind=uid")
+	assert.Equal(t, 77, allocation.ID)
+
+	rec := serveWrite(e, echo.GET, "/v1/ids/free?kind=uid", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"kind": "uid", "class": "regular", "range": {"start": 75, "end": 80}, "free": [{"start": 77, "end": 77}, {"start": 79, "end": 79}]}`, rec.Body.String())
+
+	// Expired reservations are freed
+	reservations[75] = time.Now().Add(-time.Second)
+	_, allocation = allocate("kind=uid&ttl=60")
+	assert.Equal(t, 75, allocation.ID)
+	allocate("kind=uid&ttl=60")
+	allocate("kind=uid&ttl=60")
+	code, _ = allocate("kind=uid&ttl=60")
+	assert.Equal(t, http.StatusConflict, code)
+
+	for _, query := range []string{"", "kind=pid", "kind=uid&class=root", "kind=uid&ttl=-1", "kind=uid&ttl=86400", "kind=uid&ttl=9223372037"} {
+		code, _ = allocate(query)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+}
@@ -19,11 +19,65 @@ func main() {
 	if err := readGroupFile(); err != nil {
 		log.Fatal("Error reading groups file: ", err.Error())
 	}
-	// Watch the files for changes in another goroutine, update the db if they change
-	go watchFiles()
+	// ID ranges come from login.defs, unless set by flags
+	if err := loadIDRanges(loginDefsPath); err != nil {
+		log.Fatal("Error reading login.defs: ", err.Error())
+	}
+	for key, r := range idRangeFlags {
+		idRanges[key] = r
+	}
+	if apiKeysPath != "" {
+		if err := loadAPIKeys(apiKeysPath); err != nil {
+			log.Fatal("Error reading API keys: ", err.Error())
+		}
+		go watchAPIKeys(apiKeysPath, pollInterval)
+	}
+	if clientRolesPath != "" {
+		if err := loadClientRoles(clientRolesPath); err != nil {
+			log.Fatal("Error reading client roles: ", err.Error())
+		}
+	}
+	if policiesPath != "" {
+		if err := loadPolicies(policiesPath); err != nil {
+			log.Fatal("Error reading policies: ", err.Error())
+		}
+	}
+	if rateLimitsPath != "" {
+		if err := loadRateLimits(rateLimitsPath); err != nil {
+			log.Fatal("Error reading rate limits: ", err.Error())
+		}
+	}
+	if webhooksPath != "" {
+		if err := loadWebhooks(webhooksPath); err != nil {
+			log.Fatal("Error reading webhooks config: ", err.Error())
+		}
+	}
+	// Watch the files for changes in the background, update the db if they change
+	watchFiles()
+	// Reload on SIGHUP too, to force a re-read when the watchers can't tell anything changed
+	handleReloadSignals()
 
 	// Build the echo server objects with endpoints, middleware, and TLS
+	e := newServer()
+	if autoTLS {
+		e.Logger.Fatal(e.StartAutoTLS(":" + fmt.Sprint(port)))
+	}
+	if tlsCertPath != "" {
+		tlsConfig, err := mutualTLSConfig(tlsCertPath, tlsKeyPath, clientCAPath)
+		if err != nil {
+			log.Fatal("Error loading TLS certificates: ", err.Error())
+		}
+		e.TLSServer.Addr = ":" + fmt.Sprint(port)
+		e.TLSServer.TLSConfig = tlsConfig
+		e.Logger.Fatal(e.StartServer(e.TLSServer))
+	}
+	e.Logger.Fatal(e.Start(":" + fmt.Sprint(port)))
+}
+
+// newServer builds the echo server with all endpoints and middleware
+func newServer() *echo.Echo {
 	e := echo.New()
+	e.HTTPErrorHandler = httpErrorHandler
 	if autoTLS {
 		e.Pre(middleware.HTTPSRedirect())
 		e.AutoTLSManager.Cache = autocert.DirCache("/var/www/.cache")
@@ -31,30 +85,110 @@ func main() {
 
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
+	e.Use(rateLimit)
 
-	e.GET("/healthcheck", healthCheck)
-
-	e.GET("/users", getUsers)
-	e.GET("/users/:uid", getUserByUID)
-	e.GET("/users/query", queryUsers)
-	e.GET("/users/search", searchUsers)
-
-	e.GET("/users/:uid/groups", getGroupsByMember)
-	e.GET("/groups", getGroups)
-	e.GET("/groups/query", queryGroups)
-	e.GET("/groups/:gid", getGroupByGID)
+	// The current version of the API
+	v1 := e.Group(apiVersionPrefix)
+	registerAPIRoutes(v1)
+	registerWriteRoutes(v1)
+	registerV1Routes(v1)
+	// Unversioned routes from before /v1 still work, but send deprecation headers
+	registerAPIRoutes(deprecatedRoutes{e})
 
 	e.File("/", "web/index.html")
+	e.File("/docs", "web/docs.html")
 	e.File("/jquery.min.js", "web/jquery.min.js")
 	e.HideBanner = true
-	if autoTLS {
-		e.Logger.Fatal(e.StartAutoTLS(":" + fmt.Sprint(port)))
-	}
-	e.Logger.Fatal(e.Start(":" + fmt.Sprint(port)))
+
+	// Generate the API spec from the routes registered above
+	apiSpec = buildOpenAPI(e.Routes())
+	return e
+}
+
+// apiVersionPrefix is the path prefix of the current API version
+const apiVersionPrefix = "/v1"
+
+// routeRegistrar is implemented by echo.Echo and echo.Group, so routes can be mounted on either
+type routeRegistrar interface {
+	GET(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+	POST(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+}
+
+// Scopes required by routes when authentication is enabled. Health, status, /whoami and the API spec are always open,
+// though /status only shows readiness to callers without users:read and groups:read.
+var (
+	readUsers   = requireScopes(scopeUsersRead)
+	readGroups  = requireScopes(scopeGroupsRead)
+	readAll     = requireScopes(scopeUsersRead, scopeGroupsRead)
+	writeAccess = requireScopes(scopeWrite)
+)
+
+// registerAPIRoutes adds all API endpoints to r
+func registerAPIRoutes(r routeRegistrar) {
+	r.GET("/healthcheck", healthCheck)
+	r.GET("/stats", getStats, readAll, conditionalGet)
+	r.GET("/graphql", graphqlHandler, readAll, conditionalGet)
+	r.POST("/graphql", graphqlHandler, readAll)
+
+	r.GET("/users", getUsers, readUsers, conditionalGet)
+	r.GET("/users/:uid", getUserByUID, readUsers, conditionalGet)
+	r.GET("/users/query", queryUsers, readUsers, conditionalGet)
+	r.GET("/users/search", searchUsers, requireScopes(scopeUsersRead, scopeSearch), conditionalGet)
+	r.GET("/users/aggregate", aggregateUsersBy, readUsers, conditionalGet)
+	r.POST("/users/batch", batchUsers, readUsers)
+
+	r.GET("/users/:uid/groups", getGroupsByMember, readAll, conditionalGet)
+	r.GET("/users/:uid/id", getUserIdentity, readAll, conditionalGet)
+	r.GET("/groups", getGroups, readGroups, conditionalGet)
+	r.GET("/groups/query", queryGroups, readGroups, conditionalGet)
+	r.GET("/groups/:gid", getGroupByGID, readGroups, conditionalGet)
+	r.POST("/groups/batch", batchGroups, readGroups)
+
+	r.GET("/getent/passwd", getentPasswd, readUsers, conditionalGet)
+	r.GET("/getent/passwd/:key", getentPasswd, readUsers, conditionalGet)
+	r.GET("/getent/group", getentGroup, readGroups, conditionalGet)
+	r.GET("/getent/group/:key", getentGroup, readGroups, conditionalGet)
+
+	r.GET("/openapi.json", getOpenAPI)
+}
+
+// registerV1Routes adds endpoints that were introduced after /v1, so have no unversioned alias
+func registerV1Routes(g *echo.Group) {
+	g.POST("/ids/allocate", allocateID, writeAccess)
+	g.GET("/ids/free", getFreeIDs, readAll)
+	g.POST("/plan", planChanges, writeAccess)
+	g.GET("/status", getStatus)
+	g.GET("/livez", livez)
+	g.GET("/readyz", readyz)
+	g.POST("/admin/reload", reloadData, requireAdmin)
+	g.GET("/admin/webhooks", getWebhooks, requireAdmin)
+	g.GET("/whoami", whoami)
+	g.GET("/events", streamEvents, readAll)
+	g.GET("/ws", streamEventsWS, readAll)
+}
+
+// registerWriteRoutes adds the endpoints that modify the passwd and group files.
+// They only exist under /v1, and are rejected unless pwaas was started with -writable.
+// Changes to existing users and groups must send the ETag they last read as If-Match.
+func registerWriteRoutes(g *echo.Group) {
+	g.POST("/users", createUser, writeAccess, requireWritable)
+	g.PUT("/users/:uid", updateUser, writeAccess, requireWritable, requireIfMatch)
+	g.PATCH("/users/:uid", patchUser, writeAccess, requireWritable, requireIfMatch)
+	g.DELETE("/users/:uid", deleteUser, writeAccess, requireWritable, requireIfMatch)
+	g.POST("/groups", createGroup, writeAccess, requireWritable)
+	g.DELETE("/groups/:gid", deleteGroup, writeAccess, requireWritable, requireIfMatch)
+	// If-Match is optional when adding members, as it can't overwrite anything
+	g.POST("/groups/:gid/members", addGroupMember, writeAccess, requireWritable)
+	g.DELETE("/groups/:gid/members/:name", removeGroupMember, writeAccess, requireWritable, requireIfMatch)
 }
 
 var autoTLS bool
 var port int
+var loginDefsPath string
+var webhooksPath string
+
+// idRangeFlags are the ID ranges set on the command line, keyed like idRanges
+var idRangeFlags = map[string]IDRange{}
 
 func init() {
 	// Read passwd and group file path from command line args
@@ -69,11 +203,71 @@ func init() {
 	passwdPathPtr := flag.String("passwd-file", "/etc/passwd", "path to the passwd file to host")
 	groupsPathPtr := flag.String("group-file", "/etc/group", "path to the groups file to host")
 	tlsPtr := flag.Bool("tls", false, "enable automatic TLS certification")
+	tlsCertPtr := flag.String("tls-cert", "", "path to a PEM certificate to serve HTTPS with, instead of automatic TLS")
+	tlsKeyPtr := flag.String("tls-key", "", "path to the PEM private key of -tls-cert")
+	clientCAPtr := flag.String("client-ca", "", "path to PEM CA certificates that clients must present a certificate from (requires -tls-cert)")
+	clientRolesPtr := flag.String("client-roles", "", "path to a YAML file mapping client certificates to roles (requires -client-ca)")
 	portPtr := flag.Int("port", 8000, "port to run server on")
+	writablePtr := flag.Bool("writable", false, "enable endpoints that modify the passwd and group files")
+	loginDefsPtr := flag.String("login-defs", "/etc/login.defs", "path to the login.defs file with the ID ranges to allocate from")
+	apiKeysPtr := flag.String("api-keys", "", "path to a YAML file of hashed API keys and their scopes (default no authentication)")
+	adminTokenPtr := flag.String("admin-token", "", "bearer token for the /admin endpoints, which are disabled without one")
+	maxDataAgePtr := flag.Duration("max-data-age", 0, "fail /readyz if the data hasn't matched the files for this long (default no limit)")
+	watchPtr := flag.String("watch", watchInotify, "how to detect file changes: inotify, poll or both")
+	pollIntervalPtr := flag.Duration("poll-interval", pollInterval, "how often to check the files in poll mode")
+	policiesPtr := flag.String("policies", "", "path to a YAML file of the fields and rows each role may not see (default everything is shown)")
+	rateLimitsPtr := flag.String("rate-limits", "", "path to a YAML file of per-client rate limits and per-route concurrency limits (default no limits)")
+	webhooksPtr := flag.String("webhooks", "", "path to a YAML file of webhooks to notify of user and group changes")
+	rangePtrs := map[string]*string{
+		"uid/regular": flag.String("uid-range", "", "range of regular UIDs to allocate, like 1000-60000 (default from login.defs)"),
+		"gid/regular": flag.String("gid-range", "", "range of regular GIDs to allocate (default from login.defs)"),
+		"uid/system":  flag.String("system-uid-range", "", "range of system UIDs to allocate (default from login.defs)"),
+		"gid/system":  flag.String("system-gid-range", "", "range of system GIDs to allocate (default from login.defs)"),
+	}
 	flag.Parse()
 
 	passwdFilePath = parsePath(*passwdPathPtr)
 	groupFilePath = parsePath(*groupsPathPtr)
 	autoTLS = *tlsPtr
+	tlsCertPath, tlsKeyPath, clientCAPath, clientRolesPath = *tlsCertPtr, *tlsKeyPtr, *clientCAPtr, *clientRolesPtr
+	if (tlsCertPath == "") != (tlsKeyPath == "") {
+		log.Fatal("-tls-cert and -tls-key must be used together")
+	}
+	if autoTLS && tlsCertPath != "" {
+		log.Fatal("-tls can't be used with -tls-cert")
+	}
+	if clientCAPath != "" && tlsCertPath == "" {
+		log.Fatal("-client-ca requires -tls-cert and -tls-key")
+	}
+	if clientRolesPath != "" && clientCAPath == "" {
+		log.Fatal("-client-roles requires -client-ca")
+	}
 	port = *portPtr
+	writable = *writablePtr
+	loginDefsPath = *loginDefsPtr
+	adminToken = *adminTokenPtr
+	if *apiKeysPtr != "" {
+		apiKeysPath = parsePath(*apiKeysPtr)
+	}
+	maxDataAge = *maxDataAgePtr
+	watchMode = *watchPtr
+	webhooksPath = *webhooksPtr
+	policiesPath = *policiesPtr
+	rateLimitsPath = *rateLimitsPtr
+	if watchMode != watchInotify && watchMode != watchPoll && watchMode != watchBoth {
+		log.Fatal("Invalid -watch mode: ", watchMode)
+	}
+	if pollInterval = *pollIntervalPtr; pollInterval <= 0 {
+		log.Fatal("-poll-interval must be positive")
+	}
+	for key, ptr := range rangePtrs {
+		if *ptr == "" {
+			continue
+		}
+		r, err := parseIDRange(*ptr)
+		if err != nil {
+			log.Fatal("Invalid ID range ", *ptr, ": ", err)
+		}
+		idRangeFlags[key] = r
+	}
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// dataETag identifies the current revision of both the user and group data.
+// It's weak because the same data can be rendered in several formats.
+func dataETag() string {
+	hash := sha256.Sum256([]byte(userDB.Revision().Hash + ":" + groupDB.Revision().Hash))
+	return `W/"` + hex.EncodeToString(hash[:8]) + `"`
+}
+
+// dataLastModified is the last time either the user or group data changed
+func dataLastModified() time.Time {
+	modified := userDB.Revision().Modified
+	if groupModified := groupDB.Revision().Modified; groupModified.After(modified) {
+		modified = groupModified
+	}
+	return modified
+}
+
+// conditionalGet sends ETag and Last-Modified headers for read endpoints, and responds
+// with 304 Not Modified if the client's copy is still current.
+// Data only changes on reload, so this saves clients polling for changes a full download.
+func conditionalGet(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		etag := dataETag()
+		modified := dataLastModified()
+		header := c.Response().Header()
+		header.Set(echo.HeaderVary, echo.HeaderAccept)
+		if policies != nil {
+			// What is shown depends on who is asking
+			header.Add(echo.HeaderVary, echo.HeaderAuthorization)
+		}
+		if policies != nil || clientRoles != nil {
+			// Certificate callers aren't told apart by any header, so shared caches must not
+			// serve one caller's response to another
+			header.Set("Cache-Control", "private")
+		}
+		header.Set("ETag", etag)
+		if !modified.IsZero() {
+			header.Set(echo.HeaderLastModified, modified.UTC().Format(http.TimeFormat))
+		}
+		if notModified(c.Request(), etag, modified) {
+			return c.NoContent(http.StatusNotModified)
+		}
+		return next(c)
+	}
+}
+
+// notModified checks If-None-Match, or If-Modified-Since if there's no If-None-Match
+func notModified(req *http.Request, etag string, modified time.Time) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := req.Header.Get(echo.HeaderIfModifiedSince); ims != "" && !modified.IsZero() {
+		since, err := http.ParseTime(ims)
+		// HTTP dates only have second precision
+		return err == nil && !modified.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+// contentETag is a strong ETag for the file line of a single user or group, so that it
+// changes with the resource itself rather than with the whole data set
+func contentETag(line string) string {
+	hash := sha256.Sum256([]byte(line))
+	return `"` + hex.EncodeToString(hash[:8]) + `"`
+}
+
+// lineETags are the ETags of the lines of the users and groups in the files as last read,
+// by ID, so that ETags change with every field, including the password
+var lineETags struct {
+	sync.RWMutex
+	users, groups map[int]string
+}
+
+// userETag is the ETag of a user's line in the passwd file, the same one ifMatchUser checks.
+// Users that weren't read from a file get the ETag of their formatted line.
+func userETag(user User) string {
+	lineETags.RLock()
+	defer lineETags.RUnlock()
+	if etag, ok := lineETags.users[user.UID]; ok {
+		return etag
+	}
+	return redactedUserETag(user)
+}
+
+// groupETag is userETag for a group's line in the group file
+func groupETag(group Group) string {
+	lineETags.RLock()
+	defer lineETags.RUnlock()
+	if etag, ok := lineETags.groups[group.GID]; ok {
+		return etag
+	}
+	return redactedGroupETag(group)
+}
+
+// redactedUserETag is the ETag of a user as a policy shows it, which isn't a line in the file
+func redactedUserETag(user User) string {
+	return contentETag(formatPasswdLine(user))
+}
+
+func redactedGroupETag(group Group) string {
+	return contentETag(formatGroupLine(group))
+}
+
+// resourceNotModified replaces the data ETag set by conditionalGet with the ETag of a single
+// resource, which clients send back as If-Match when writing it. It reports whether the
+// client's copy is current.
+func resourceNotModified(c echo.Context, etag string) bool {
+	c.Response().Header().Set("ETag", etag)
+	// If-Modified-Since has already been checked by conditionalGet
+	return notModified(c.Request(), etag, time.Time{})
+}
+
+// requireIfMatch rejects writes to existing resources without an If-Match header, so that
+// clients can't overwrite changes they haven't seen. The ETag itself is checked by the edit,
+// under the file lock - see ifMatchUser and ifMatchGroup.
+func requireIfMatch(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if c.Request().Header.Get("If-Match") == "" {
+			return errPreconditionRequired
+		}
+		return next(c)
+	}
+}
+
+// etagMatches checks an If-Match header against an ETag, using the strong comparison RFC 7232 requires
+func etagMatches(ifMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || (candidate == etag && !strings.HasPrefix(candidate, "W/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// adminToken is the bearer token for the /admin endpoints, which are disabled if it is empty
+var adminToken string
+
+// requireAdmin rejects requests to admin endpoints that don't send adminToken as a bearer token,
+// and aren't from a caller with the admin scope
+func requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	withScope := requireScopes(scopeAdmin)(next)
+	return func(c echo.Context) error {
+		if adminToken == "" && !authEnabled() {
+			return errAdminDisabled
+		}
+		auth := c.Request().Header.Get(echo.HeaderAuthorization)
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if adminToken != "" && token != auth && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+			return next(c)
+		}
+		if authEnabled() {
+			return withScope(c)
+		}
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+		return errUnauthorized
+	}
+}
+
+// deprecatedRoutes registers routes on the root of the echo server, with deprecation headers
+// pointing clients to the same route under apiVersionPrefix
+type deprecatedRoutes struct {
+	e *echo.Echo
+}
+
+func (r deprecatedRoutes) GET(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route {
+	return r.e.GET(path, h, append([]echo.MiddlewareFunc{deprecated}, m...)...)
+}
+
+func (r deprecatedRoutes) POST(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route {
+	return r.e.POST(path, h, append([]echo.MiddlewareFunc{deprecated}, m...)...)
+}
+
+// deprecated marks a response as coming from an unversioned route, and links to its /v1 successor
+func deprecated(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		header := c.Response().Header()
+		header.Set("Deprecation", "true")
+		header.Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, apiVersionPrefix+c.Request().URL.RequestURI()))
+		return next(c)
+	}
+}
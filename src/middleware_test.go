@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func mockConditionalRequest(t *testing.T, headers map[string]string) *httptest.ResponseRecorder {
+	e := echo.New()
+	req := httptest.NewRequest(echo.GET, "/users", nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	assert.NoError(t, conditionalGet(getUsers)(e.NewContext(req, rec)))
+	return rec
+}
+
+func TestRevision(t *testing.T) {
+	userDB.SetUserList(testUser1)
+	rev := userDB.Revision()
+	assert.NotEmpty(t, rev.Hash)
+	assert.False(t, rev.Modified.IsZero())
+
+	// Setting the same data keeps the revision
+	userDB.SetUserList(testUser1)
+	assert.Equal(t, rev, userDB.Revision())
+
+	userDB.SetUserList(testUser1, testUser2)
+	assert.NotEqual(t, rev.Hash, userDB.Revision().Hash)
+}
+
+func TestConditionalGet(t *testing.T) {
+	passwdFilePath = passwdTestFile
+	assert.NoError(t, readPasswdFile())
+	groupFilePath = "../sample_files/group.test.txt"
+	assert.NoError(t, readGroupFile())
+
+	rec := mockConditionalRequest(t, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	etag := rec.Header().Get("ETag")
+	lastModified := rec.Header().Get(echo.HeaderLastModified)
+	assert.NotEmpty(t, etag)
+	assert.NotEmpty(t, lastModified)
+	// Shared caches can store responses when callers can all see the same thing
+	assert.Empty(t, rec.Header().Get("Cache-Control"))
+
+	rec = mockConditionalRequest(t, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Body.String())
+
+	rec = mockConditionalRequest(t, map[string]string{"If-None-Match": `W/"stale", ` + etag})
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	rec = mockConditionalRequest(t, map[string]string{echo.HeaderIfModifiedSince: lastModified})
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	// If-None-Match takes precedence over If-Modified-Since
+	rec = mockConditionalRequest(t, map[string]string{"If-None-Match": `W/"stale"`, echo.HeaderIfModifiedSince: lastModified})
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	older := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	rec = mockConditionalRequest(t, map[string]string{echo.HeaderIfModifiedSince: older})
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// A change in either list changes the ETag
+	groupDB.SetGroupList(testGroup1)
+	rec = mockConditionalRequest(t, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+}
+
+func TestVersionedRoutes(t *testing.T) {
+	passwdFilePath = passwdTestFile
+	assert.NoError(t, readPasswdFile())
+	e := newServer()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(echo.GET, "/v1/users/78", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("Deprecation"))
+	body := rec.Body.String()
+
+	// Unversioned routes return the same response, marked deprecated
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(echo.GET, "/users/78?pretty", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "true", rec.Header().Get("Deprecation"))
+	assert.Equal(t, `</v1/users/78?pretty>; rel="successor-version"`, rec.Header().Get("Link"))
+	assert.JSONEq(t, body, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(echo.GET, "/users", nil)
+	req.Header.Set("If-None-Match", dataETag())
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Equal(t, "true", rec.Header().Get("Deprecation"))
+}
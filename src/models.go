@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 // User represents a UNIX user in a passwd file
 type User struct {
 	Name    string `json:"name"`
@@ -23,10 +25,19 @@ type UserDB interface {
 	SetUserList(...User)
 	Query(map[string]interface{}) []User
 	Search(term string) []User
+	Revision() Revision
 }
 
 // GroupDB is an interface to store and query Groups
 type GroupDB interface {
 	SetGroupList(...Group)
 	Query(map[string]interface{}) []Group
+	Revision() Revision
+}
+
+// Revision identifies a version of the data in a UserDB or GroupDB
+// Hash is derived from the contents, so it only changes when the data does
+type Revision struct {
+	Hash     string
+	Modified time.Time
 }
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+/*
+	The OpenAPI spec served at /openapi.json is generated from the routes registered
+	on the echo server in newServer(), documented by the entries in routeDocs.
+	Schemas are derived from the response types (User, Group, ...) through their json tags.
+	Every route must have an entry in routeDocs - the tests enforce this.
+	Routes are documented without their /v1 prefix. Unversioned aliases are marked deprecated.
+*/
+
+// paramDoc documents a path or query parameter
+type paramDoc struct {
+	Name        string
+	In          string
+	Type        string
+	Description string
+	Required    bool
+	// Repeated params like ?member=a&member=b
+	Multi bool
+}
+
+// routeDoc documents a single route
+type routeDoc struct {
+	Summary string
+	Params  []paramDoc
+	// Body is an example of the JSON request body type, nil if there is no body
+	Body interface{}
+	// Response is an example of the response type, used to derive its schema
+	Response interface{}
+	// ContentType of the response, JSON by default
+	ContentType string
+	// Status of a successful response, 200 by default. 204 responses have no body.
+	Status int
+	// Rendered responses honor Accept and ?format=, see render.go
+	Rendered bool
+}
+
+// undocumentedRoutes are static web assets, not part of the API
+var undocumentedRoutes = map[string]bool{
+	"GET /":              true,
+	"GET /docs":          true,
+	"GET /jquery.min.js": true,
+}
+
+var uidParam = paramDoc{Name: "uid", In: "path", Type: "integer", Required: true, Description: "User ID"}
+var gidParam = paramDoc{Name: "gid", In: "path", Type: "integer", Required: true, Description: "Group ID"}
+var ifMatchParam = paramDoc{Name: "If-Match", In: "header", Type: "string", Required: true, Description: "ETag of the resource from a GET"}
+var adminAuthParam = paramDoc{Name: "Authorization", In: "header", Type: "string", Required: true, Description: "Bearer <admin token>"}
+var keyParam = paramDoc{Name: "key", In: "path", Type: "string", Required: true, Description: "Name or numeric ID"}
+
+var userQueryParams = []paramDoc{
+	{Name: "name", In: "query", Type: "string"},
+	{Name: "uid", In: "query", Type: "integer"},
+	{Name: "gid", In: "query", Type: "integer"},
+	{Name: "comment", In: "query", Type: "string"},
+	{Name: "home", In: "query", Type: "string"},
+	{Name: "shell", In: "query", Type: "string"},
+}
+
+var groupQueryParams = []paramDoc{
+	{Name: "name", In: "query", Type: "string"},
+	{Name: "gid", In: "query", Type: "integer"},
+	{Name: "member", In: "query", Type: "string", Multi: true, Description: "Groups must contain all given members"},
+}
+
+var idClassParams = []paramDoc{
+	{Name: "kind", In: "query", Type: "string", Required: true, Description: "uid or gid"},
+	{Name: "class", In: "query", Type: "string", Description: "system or regular (default)"},
+}
+
+var lastEventIDParam = paramDoc{Name: "last_event_id", In: "query", Type: "integer", Description: "Resume after this event ID, for clients that can't send Last-Event-ID"}
+
+// routeDocs are keyed by "<METHOD> <path>", with paths as registered in registerAPIRoutes
+var routeDocs = map[string]routeDoc{
+	"GET /healthcheck": {Summary: "Health check", Response: "OK", ContentType: echo.MIMETextPlain},
+	"GET /stats":       {Summary: "User and group statistics", Response: Stats{}, Rendered: true},
+	"GET /graphql": {
+		Summary:  "Run a GraphQL query",
+		Params:   []paramDoc{{Name: "query", In: "query", Type: "string", Required: true}, {Name: "operationName", In: "query", Type: "string"}},
+		Response: map[string]interface{}{},
+	},
+	"POST /graphql":   {Summary: "Run a GraphQL query", Body: GraphQLRequest{}, Response: map[string]interface{}{}},
+	"GET /users":      {Summary: "List users", Response: []User{}, Rendered: true},
+	"GET /users/:uid": {Summary: "Get a user by UID", Params: []paramDoc{uidParam}, Response: User{}, Rendered: true},
+	"GET /users/query": {
+		Summary:  "Query users by exact field matches",
+		Params:   userQueryParams,
+		Response: []User{},
+		Rendered: true,
+	},
+	"GET /users/search": {
+		Summary:  "Search users by text, returning the 3 best matches",
+		Params:   []paramDoc{{Name: "q", In: "query", Type: "string", Required: true}},
+		Response: []User{},
+		Rendered: true,
+	},
+	"GET /users/aggregate": {
+		Summary:  "Count users by the value of a field",
+		Params:   []paramDoc{{Name: "by", In: "query", Type: "string", Required: true, Description: "A user field name"}},
+		Response: map[string]int{},
+		Rendered: true,
+	},
+	"POST /users/batch": {Summary: "Look up many users by UID or name", Body: BatchRequest{}, Response: map[string]UserBatchResult{}},
+	"GET /users/:uid/groups": {
+		Summary:  "List the groups a user is a member of",
+		Params:   []paramDoc{uidParam},
+		Response: []Group{},
+		Rendered: true,
+	},
+	"POST /users": {
+		Summary:  "Create a user (requires -writable)",
+		Body:     User{},
+		Response: User{},
+		Status:   http.StatusCreated,
+	},
+	"PUT /users/:uid": {
+		Summary:  "Replace a user (requires -writable)",
+		Params:   []paramDoc{uidParam, ifMatchParam},
+		Body:     User{},
+		Response: User{},
+	},
+	"PATCH /users/:uid": {
+		Summary:  "Change some fields of a user (requires -writable)",
+		Params:   []paramDoc{uidParam, ifMatchParam},
+		Body:     User{},
+		Response: User{},
+	},
+	"DELETE /users/:uid": {
+		Summary: "Delete a user (requires -writable)",
+		Params:  []paramDoc{uidParam, ifMatchParam},
+		Status:  http.StatusNoContent,
+	},
+	"GET /users/:uid/id": {Summary: "Get a user's identity, like `id`", Params: []paramDoc{uidParam}, Response: Identity{}},
+	"GET /groups":        {Summary: "List groups", Response: []Group{}, Rendered: true},
+	"GET /groups/query": {
+		Summary:  "Query groups by exact field matches and members",
+		Params:   groupQueryParams,
+		Response: []Group{},
+		Rendered: true,
+	},
+	"GET /groups/:gid": {Summary: "Get a group by GID", Params: []paramDoc{gidParam}, Response: Group{}, Rendered: true},
+	"POST /groups": {
+		Summary:  "Create a group (requires -writable)",
+		Body:     Group{},
+		Response: Group{},
+		Status:   http.StatusCreated,
+	},
+	"DELETE /groups/:gid": {
+		Summary: "Delete a group (requires -writable)",
+		Params:  []paramDoc{gidParam, ifMatchParam},
+		Status:  http.StatusNoContent,
+	},
+	"POST /groups/:gid/members": {
+		Summary:  "Add a user to a group (requires -writable)",
+		Params:   []paramDoc{gidParam, {Name: "If-Match", In: "header", Type: "string", Description: "ETag of the group from a GET"}},
+		Body:     MemberRequest{},
+		Response: Group{},
+	},
+	"DELETE /groups/:gid/members/:name": {
+		Summary:  "Remove a user from a group (requires -writable)",
+		Params:   []paramDoc{gidParam, {Name: "name", In: "path", Type: "string", Required: true, Description: "User name"}, ifMatchParam},
+		Response: Group{},
+	},
+	"POST /groups/batch": {Summary: "Look up many groups by GID or name", Body: BatchRequest{}, Response: map[string]GroupBatchResult{}},
+	"GET /getent/passwd": {Summary: "List users as passwd lines", Response: "", ContentType: echo.MIMETextPlain},
+	"GET /getent/group":  {Summary: "List groups as group lines", Response: "", ContentType: echo.MIMETextPlain},
+	"POST /ids/allocate": {
+		Summary:  "Allocate the lowest free UID or GID",
+		Params:   append(idClassParams, paramDoc{Name: "ttl", In: "query", Type: "integer", Description: "Seconds to reserve the ID for"}),
+		Response: IDAllocation{},
+	},
+	"GET /ids/free": {Summary: "List the free UIDs or GIDs in a range", Params: idClassParams, Response: FreeIDs{}},
+	"POST /plan": {
+		Summary:  "Preview user and group changes as unified diffs, without writing them",
+		Body:     PlanRequest{},
+		Response: Plan{},
+	},
+	"GET /status": {Summary: "Server status: data freshness, reloads and how file changes are detected. With authentication, only readiness without users:read and groups:read", Response: Status{}},
+	"GET /livez":  {Summary: "Liveness check", Response: "OK", ContentType: echo.MIMETextPlain},
+	"GET /readyz": {Summary: "Readiness check, failing if the data is missing or stale", Response: "OK", ContentType: echo.MIMETextPlain},
+	"POST /admin/reload": {
+		Summary:  "Re-read the passwd and group files (requires -admin-token)",
+		Params:   []paramDoc{adminAuthParam},
+		Response: ReloadResult{},
+	},
+	"GET /admin/webhooks": {
+		Summary:  "Webhook delivery status and dead letters (requires -admin-token)",
+		Params:   []paramDoc{adminAuthParam},
+		Response: WebhooksStatus{},
+	},
+	"GET /whoami": {Summary: "Who the request authenticated as, with its roles and scopes", Response: Caller{}},
+	"GET /events": {
+		Summary: "Stream user and group changes as Server-Sent Events, with ChangeEvent data",
+		Params: []paramDoc{
+			{Name: "Last-Event-ID", In: "header", Type: "integer", Description: "Resume after this event ID"},
+			lastEventIDParam,
+		},
+		Response:    ChangeEvent{},
+		ContentType: "text/event-stream",
+	},
+	"GET /ws": {
+		Summary:  "Stream user and group changes over a WebSocket, as JSON ChangeEvent messages",
+		Params:   []paramDoc{lastEventIDParam},
+		Response: ChangeEvent{},
+		Status:   http.StatusSwitchingProtocols,
+	},
+	"GET /openapi.json": {Summary: "This OpenAPI spec", Response: map[string]interface{}{}},
+	"GET /getent/passwd/:key": {
+		Summary:     "Get a user as a passwd line",
+		Params:      []paramDoc{keyParam},
+		Response:    "",
+		ContentType: echo.MIMETextPlain,
+	},
+	"GET /getent/group/:key": {
+		Summary:     "Get a group as a group line",
+		Params:      []paramDoc{keyParam},
+		Response:    "",
+		ContentType: echo.MIMETextPlain,
+	},
+}
+
+// apiSpec is the generated OpenAPI document, set by newServer
+var apiSpec map[string]interface{}
+
+func getOpenAPI(c echo.Context) error {
+	return c.JSON(http.StatusOK, apiSpec)
+}
+
+var pathParamPattern = regexp.MustCompile(`:(\w+)`)
+
+// buildOpenAPI generates an OpenAPI 3 document for the given routes
+func buildOpenAPI(routes []*echo.Route) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	paths := map[string]map[string]interface{}{}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Path < routes[j].Path })
+	for _, route := range routes {
+		key, versioned := routeDocKey(route)
+		if !isAPIRoute(route) {
+			continue
+		}
+		doc, ok := routeDocs[key]
+		if !ok {
+			log.Println("Route is missing from the API docs:", key)
+			continue
+		}
+		path := pathParamPattern.ReplaceAllString(route.Path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		op := buildOperation(doc, schemas)
+		if !versioned {
+			op["deprecated"] = true
+		}
+		paths[path][strings.ToLower(route.Method)] = op
+	}
+	schemas["Problem"] = schemaOf(reflect.TypeOf(Problem{}), schemas)
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Passwd as a Service",
+			"description": "API to expose the user and group information on a UNIX system",
+			"version":     "1.0.0",
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas},
+	}
+}
+
+// isAPIRoute is false for static web assets, and the catch-all routes echo adds to groups
+func isAPIRoute(route *echo.Route) bool {
+	key, _ := routeDocKey(route)
+	path := strings.TrimPrefix(route.Path, apiVersionPrefix)
+	return !undocumentedRoutes[key] && path != "" && path != "/*"
+}
+
+// routeDocKey returns the routeDocs key of a route, and whether it's under apiVersionPrefix
+func routeDocKey(route *echo.Route) (string, bool) {
+	path := strings.TrimPrefix(route.Path, apiVersionPrefix)
+	return route.Method + " " + path, path != route.Path
+}
+
+func buildOperation(doc routeDoc, schemas map[string]interface{}) map[string]interface{} {
+	params := []interface{}{}
+	for _, param := range doc.Params {
+		schema := map[string]interface{}{"type": param.Type}
+		if param.Multi {
+			schema = map[string]interface{}{"type": "array", "items": schema}
+		}
+		p := map[string]interface{}{
+			"name":     param.Name,
+			"in":       param.In,
+			"required": param.Required,
+			"schema":   schema,
+		}
+		if param.Description != "" {
+			p["description"] = param.Description
+		}
+		params = append(params, p)
+	}
+	if doc.Rendered {
+		params = append(params, map[string]interface{}{
+			"name":        "format",
+			"in":          "query",
+			"description": "Response format, overriding the Accept header",
+			"schema": map[string]interface{}{
+				"type": "string",
+				"enum": []string{"json", "ndjson", "csv", "yaml", "passwd", "group"},
+			},
+		}, map[string]interface{}{
+			"name":            "pretty",
+			"in":              "query",
+			"description":     "Indent JSON responses",
+			"schema":          map[string]interface{}{"type": "boolean"},
+			"allowEmptyValue": true,
+		})
+	}
+	contentType := doc.ContentType
+	if contentType == "" {
+		contentType = echo.MIMEApplicationJSON
+	}
+	status := doc.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	if status != http.StatusNoContent {
+		success["content"] = map[string]interface{}{
+			contentType: map[string]interface{}{"schema": schemaOf(reflect.TypeOf(doc.Response), schemas)},
+		}
+	}
+	op := map[string]interface{}{
+		"summary":    doc.Summary,
+		"parameters": params,
+		"responses": map[string]interface{}{
+			strconv.Itoa(status): success,
+			"default": map[string]interface{}{
+				"description": "Error",
+				"content": map[string]interface{}{
+					mimeProblemJSON: map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/Problem"}},
+				},
+			},
+		},
+	}
+	if doc.Body != nil {
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				echo.MIMEApplicationJSON: map[string]interface{}{"schema": schemaOf(reflect.TypeOf(doc.Body), schemas)},
+			},
+		}
+	}
+	return op
+}
+
+// schemaOf derives a JSON schema from a Go type. Named structs are added to schemas and referenced.
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem(), schemas)
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := schemas[t.Name()]; ok {
+			return ref
+		}
+		// Reserve the name first in case the type refers to itself
+		schemas[t.Name()] = nil
+		properties := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			if name := jsonName(t.Field(i)); name != "" {
+				properties[name] = schemaOf(t.Field(i).Type, schemas)
+			}
+		}
+		schemas[t.Name()] = map[string]interface{}{"type": "object", "properties": properties}
+		return ref
+	}
+	// interface{} can be anything
+	return map[string]interface{}{}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Fails if a route is registered in newServer without being documented in routeDocs
+func TestAllRoutesDocumented(t *testing.T) {
+	e := newServer()
+	for _, route := range e.Routes() {
+		if !isAPIRoute(route) {
+			continue
+		}
+		key, _ := routeDocKey(route)
+		_, ok := routeDocs[key]
+		assert.True(t, ok, "route %s is not documented in routeDocs", key)
+	}
+	// And that no docs are left over for routes that no longer exist
+	registered := map[string]bool{}
+	for _, route := range e.Routes() {
+		if key, versioned := routeDocKey(route); versioned && isAPIRoute(route) {
+			registered[key] = true
+		}
+	}
+	for key := range routeDocs {
+		assert.True(t, registered[key], "documented route %s is not registered", key)
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	e := newServer()
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/openapi.json", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var spec struct {
+		OpenAPI    string                            `json:"openapi"`
+		Paths      map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]map[string]interface{} `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &spec))
+	assert.Equal(t, "3.0.3", spec.OpenAPI)
+	assert.Contains(t, spec.Paths, "/v1/users/{uid}")
+	assert.Contains(t, spec.Paths["/v1/users/batch"], "post")
+	assert.Nil(t, spec.Paths["/v1/users"]["get"].(map[string]interface{})["deprecated"])
+	assert.Equal(t, true, spec.Paths["/users"]["get"].(map[string]interface{})["deprecated"])
+
+	user := spec.Components.Schemas["User"].Properties
+	assert.Len(t, user, 6)
+	assert.Equal(t, "integer", user["uid"]["type"])
+	assert.Equal(t, "string", user["shell"]["type"])
+	assert.Equal(t, "array", spec.Components.Schemas["Group"].Properties["members"]["type"])
+}
@@ -104,3 +104,26 @@ func parseGroups(reader io.Reader) (groups []Group, err error) {
 	}
 	return
 }
+
+// formatPasswdLine renders a user as a passwd file line - the inverse of parsePasswd
+func formatPasswdLine(user User) string {
+	return strings.Join([]string{
+		user.Name,
+		"x",
+		strconv.Itoa(user.UID),
+		strconv.Itoa(user.GID),
+		user.Comment,
+		user.Home,
+		user.Shell,
+	}, ":")
+}
+
+// formatGroupLine renders a group as a group file line - the inverse of parseGroups
+func formatGroupLine(group Group) string {
+	return strings.Join([]string{
+		group.Name,
+		"x",
+		strconv.Itoa(group.GID),
+		strings.Join(group.Members, ","),
+	}, ":")
+}
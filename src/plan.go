@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+/*
+	POST /plan previews a list of changes without writing anything. Each operation is
+	applied in order to copies of the passwd and group file lines, with the same edits
+	and checks as the write endpoints. Operations that fail are reported and skipped.
+*/
+
+// maxPlanOperations caps the number of operations in a single plan
+const maxPlanOperations = 1000
+
+// Plan operation names
+const (
+	opCreateUser   = "create-user"
+	opUpdateUser   = "update-user"
+	opDeleteUser   = "delete-user"
+	opCreateGroup  = "create-group"
+	opDeleteGroup  = "delete-group"
+	opAddMember    = "add-member"
+	opRemoveMember = "remove-member"
+)
+
+// PlanOperation is a single change in a plan. Which fields are needed depends on Op:
+// users are created and updated from User, deleted by UID; groups are created from Group,
+// deleted by GID; and members are added to and removed from GID by Name.
+type PlanOperation struct {
+	Op    string `json:"op"`
+	User  *User  `json:"user,omitempty"`
+	Group *Group `json:"group,omitempty"`
+	UID   *int   `json:"uid,omitempty"`
+	GID   *int   `json:"gid,omitempty"`
+	Name  string `json:"name,omitempty"`
+	// userJSON and groupJSON are User and Group as sent, to check which fields they have
+	userJSON, groupJSON json.RawMessage
+}
+
+// UnmarshalJSON decodes an operation, keeping its user and group as sent
+func (op *PlanOperation) UnmarshalJSON(data []byte) error {
+	type plainOperation PlanOperation
+	if err := json.Unmarshal(data, (*plainOperation)(op)); err != nil {
+		return err
+	}
+	var raw struct {
+		User  json.RawMessage `json:"user"`
+		Group json.RawMessage `json:"group"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	op.userJSON, op.groupJSON = raw.User, raw.Group
+	return nil
+}
+
+// PlanRequest is the body of POST /plan
+type PlanRequest struct {
+	Operations []PlanOperation `json:"operations"`
+}
+
+// PlanFinding is a problem found while planning. Errors are operations that
+// would fail, warnings are suspicious but valid results.
+type PlanFinding struct {
+	Severity string `json:"severity"`
+	// Operation is the index of the operation the finding is about, if any
+	Operation *int   `json:"operation,omitempty"`
+	Code      string `json:"code"`
+	Detail    string `json:"detail"`
+	Param     string `json:"param,omitempty"`
+}
+
+// Plan is the outcome of applying a PlanRequest: unified diffs of both files, and any findings
+type Plan struct {
+	// Valid is true if there are no errors, so applying every operation would succeed
+	Valid    bool          `json:"valid"`
+	Passwd   string        `json:"passwd"`
+	Group    string        `json:"group"`
+	Findings []PlanFinding `json:"findings"`
+}
+
+// Finding codes for problems in the planned files
+const (
+	codeMissingPrimaryGroup = "missing_primary_group"
+	codeUnknownMember       = "unknown_member"
+	codeUnparseable         = "unparseable"
+)
+
+// planEdits works out the edit an operation makes, checking it against the planned users
+func planEdits(op PlanOperation, users []User) (passwdEdit, groupEdit lineEdit, err error) {
+	requireID := func(id *int, param string) error {
+		if id == nil {
+			return badRequest(codeInvalidParam, param, fmt.Sprintf("'%s' is required for %s", param, op.Op))
+		}
+		return nil
+	}
+	switch op.Op {
+	case opCreateUser, opUpdateUser:
+		if op.User == nil {
+			return nil, nil, badRequest(codeInvalidParam, "user", fmt.Sprintf("'user' is required for %s", op.Op))
+		}
+		// The same fields as POST /users and PUT /users/:uid, whose path has the UID
+		if err = requireFields(op.userJSON, "uid", "gid"); err != nil {
+			return
+		}
+		if err = validateUser(*op.User); err != nil {
+			return
+		}
+		if op.Op == opCreateUser {
+			return addUserLine(*op.User), nil, nil
+		}
+		return updateUserLine(op.User.UID, *op.User), nil, nil
+	case opDeleteUser:
+		if err = requireID(op.UID, "uid"); err != nil {
+			return
+		}
+		return deleteUserLine(*op.UID), nil, nil
+	case opCreateGroup:
+		if op.Group == nil {
+			return nil, nil, badRequest(codeInvalidParam, "group", "'group' is required for create-group")
+		}
+		if err = requireFields(op.groupJSON, "gid"); err != nil {
+			return
+		}
+		group := *op.Group
+		if err = prepareGroup(&group, users); err != nil {
+			return
+		}
+		return nil, addGroupLine(group), nil
+	case opDeleteGroup:
+		if err = requireID(op.GID, "gid"); err != nil {
+			return
+		}
+		if err = requireNotPrimaryGroup(users, *op.GID); err != nil {
+			return
+		}
+		return nil, deleteGroupLine(*op.GID), nil
+	case opAddMember, opRemoveMember:
+		if err = requireID(op.GID, "gid"); err != nil {
+			return
+		}
+		var group Group
+		if op.Op == opRemoveMember {
+			return nil, editMembersLine(*op.GID, removeMember(op.Name), &group), nil
+		}
+		if err = requireUsers(users, []string{op.Name}, "name"); err != nil {
+			return
+		}
+		return nil, editMembersLine(*op.GID, addMember(op.Name), &group), nil
+	}
+	return nil, nil, badRequest(codeInvalidParam, "op", fmt.Sprintf("'%s' is not an operation", op.Op))
+}
+
+// applyEdit runs edit on a copy of lines, so lines are untouched if it fails
+func applyEdit(edit lineEdit, lines []string) ([]string, error) {
+	if edit == nil {
+		return lines, nil
+	}
+	return edit(append([]string(nil), lines...))
+}
+
+// buildPlan applies operations to the given file contents and diffs the results
+func buildPlan(operations []PlanOperation, passwd, group []byte) Plan {
+	plan := Plan{Findings: []PlanFinding{}}
+	addFinding := func(severity string, index *int, err error) {
+		finding := PlanFinding{Severity: severity, Operation: index, Code: codeInternal, Detail: err.Error()}
+		if apiErr, ok := err.(*APIError); ok {
+			finding.Code, finding.Param = apiErr.Code, apiErr.Param
+		}
+		plan.Findings = append(plan.Findings, finding)
+	}
+
+	passwdLines, groupLines := splitLines(passwd), splitLines(group)
+	for i, op := range operations {
+		index := i
+		passwdEdit, groupEdit, err := planEdits(op, usersInLines(passwdLines))
+		if err != nil {
+			addFinding("error", &index, err)
+			continue
+		}
+		newPasswd, err := applyEdit(passwdEdit, passwdLines)
+		if err != nil {
+			addFinding("error", &index, err)
+			continue
+		}
+		newGroup, err := applyEdit(groupEdit, groupLines)
+		if err != nil {
+			addFinding("error", &index, err)
+			continue
+		}
+		passwdLines, groupLines = newPasswd, newGroup
+	}
+
+	// Parse the results just like they would be read back from disk
+	users, err := parsePasswd(bytes.NewReader(joinLines(passwdLines)))
+	if err != nil {
+		addFinding("error", nil, &APIError{Code: codeUnparseable, Param: "passwd", Detail: err.Error()})
+	}
+	groups, err := parseGroups(bytes.NewReader(joinLines(groupLines)))
+	if err != nil {
+		addFinding("error", nil, &APIError{Code: codeUnparseable, Param: "group", Detail: err.Error()})
+	}
+	// Only warn about problems the operations introduce
+	existing := make(map[string]bool)
+	for _, err := range planWarnings(usersInLines(splitLines(passwd)), groupsInLines(splitLines(group))) {
+		existing[err.Error()] = true
+	}
+	for _, err := range planWarnings(users, groups) {
+		if !existing[err.Error()] {
+			addFinding("warning", nil, err)
+		}
+	}
+
+	plan.Valid = true
+	for _, finding := range plan.Findings {
+		if finding.Severity == "error" {
+			plan.Valid = false
+		}
+	}
+	plan.Passwd = unifiedDiff("a/passwd", "b/passwd", splitLines(passwd), passwdLines)
+	plan.Group = unifiedDiff("a/group", "b/group", splitLines(group), groupLines)
+	return plan
+}
+
+// planWarnings finds users whose primary group doesn't exist, and group members who aren't users
+func planWarnings(users []User, groups []Group) (warnings []error) {
+	gids := make(map[int]bool)
+	for _, group := range groups {
+		gids[group.GID] = true
+	}
+	names := make(map[string]bool)
+	for _, user := range users {
+		names[user.Name] = true
+		if !gids[user.GID] {
+			warnings = append(warnings, &APIError{
+				Code:   codeMissingPrimaryGroup,
+				Param:  "gid",
+				Detail: fmt.Sprintf("User '%s' has primary GID %d, which is not a group", user.Name, user.GID),
+			})
+		}
+	}
+	for _, group := range groups {
+		for _, member := range groupMembers(group) {
+			if !names[member] {
+				warnings = append(warnings, &APIError{
+					Code:   codeUnknownMember,
+					Param:  "members",
+					Detail: fmt.Sprintf("Group '%s' has member '%s', who is not a user", group.Name, member),
+				})
+			}
+		}
+	}
+	return
+}
+
+// planChanges previews a list of user and group operations as unified diffs, without writing anything
+func planChanges(c echo.Context) error {
+	// The diffs and findings show whole file lines, which can't be redacted field by field
+	if callerPolicies(c).hidesAnything() {
+		return errRestrictedByPolicy
+	}
+	var request PlanRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&request); err != nil {
+		return badRequest(codeInvalidBody, "", "Request body must be a JSON object with 'operations'")
+	}
+	if len(request.Operations) > maxPlanOperations {
+		return badRequest(codeTooManyValues, "operations", fmt.Sprintf("'operations' cannot have more than %d entries", maxPlanOperations))
+	}
+	passwd, err := ioutil.ReadFile(passwdFilePath)
+	if err != nil {
+		return err
+	}
+	group, err := ioutil.ReadFile(groupFilePath)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, buildPlan(request.Operations, passwd, group))
+}
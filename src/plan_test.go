@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlan(t *testing.T) {
+	passwdFilePath = passwdTestFile
+	groupFilePath = groupTestFile
+	passwdBefore, _ := ioutil.ReadFile(passwdFilePath)
+	groupBefore, _ := ioutil.ReadFile(groupFilePath)
+	e := newServer()
+
+	rec := serveWrite(e, echo.POST, "/v1/plan", `{"operations": [
+		{"op": "create-user", "user": {"name": "alice", "uid": 1000, "gid": 1000, "home": "/home/alice", "shell": "/bin/sh"}},
+		{"op": "create-group", "group": {"name": "alice", "gid": 1000}},
+		{"op": "add-member", "gid": 24, "name": "alice"},
+		{"op": "remove-member", "gid": 24, "name": "bob"},
+		{"op": "update-user", "user": {"name": "bob", "uid": 78, "gid": 78, "comment": "Robert", "home": "/home/bob", "shell": "/bin/sh"}},
+		{"op": "delete-user", "uid": 0}
+	]}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var plan Plan
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &plan))
+	assert.True(t, plan.Valid)
+	assert.Equal(t, `--- a/passwd
++++ b/passwd
+@@ -1,4 +1,4 @@
+ # this is a comment
+ 
+-bob:*:78:78:Bob Jones:/home/bob:/bin/bash
+-root:*:0:0:Root User:/root:/bin/bash
++bob:*:78:78:Robert:/home/bob:/bin/sh
++alice:x:1000:1000::/home/alice:/bin/sh
+`, plan.Passwd)
+	assert.Equal(t, `--- a/group
++++ b/group
+@@ -1,4 +1,5 @@
+ # this is a comment
+ 
+-mygroup:*:24:bob,root
++mygroup:*:24:root,alice
+ admin:*:80:root
++alice:x:1000:
+`, plan.Group)
+	// root is still a member of groups after being deleted
+	assert.Len(t, plan.Findings, 2)
+	for _, finding := range plan.Findings {
+		assert.Equal(t, "warning", finding.Severity)
+		assert.Equal(t, codeUnknownMember, finding.Code)
+	}
+
+	// Nothing is written
+	passwdAfter, _ := ioutil.ReadFile(passwdFilePath)
+	groupAfter, _ := ioutil.ReadFile(groupFilePath)
+	assert.Equal(t, passwdBefore, passwdAfter)
+	assert.Equal(t, groupBefore, groupAfter)
+
+	// Failed operations are reported and skipped, later ones still apply
+	rec = serveWrite(e, echo.POST, "/v1/plan", `{"operations": [
+		{"op": "create-user", "user": {"name": "root", "uid": 1000, "gid": 0, "home": "/root"}},
+		{"op": "add-member", "gid": 80, "name": "nobody"},
+		{"op": "delete-group", "gid": 24},
+		{"op": "delete-user"},
+		{"op": "rename-user"}
+	]}`)
+	plan = Plan{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &plan))
+	assert.False(t, plan.Valid)
+	assert.Equal(t, "", plan.Passwd)
+	assert.Contains(t, plan.Group, "-mygroup:*:24:bob,root\n")
+	codes := map[int]string{}
+	for _, finding := range plan.Findings {
+		assert.Equal(t, "error", finding.Severity)
+		codes[*finding.Operation] = finding.Code
+	}
+	assert.Equal(t, map[int]string{0: codeConflict, 1: codeInvalidParam, 3: codeInvalidParam, 4: codeInvalidParam}, codes)
+}
+
+func TestPlanRequiresIDs(t *testing.T) {
+	passwdFilePath = passwdTestFile
+	groupFilePath = groupTestFile
+	e := newServer()
+
+	// Like the write endpoints, missing IDs aren't taken as 0
+	rec := serveWrite(e, echo.POST, "/v1/plan", `{"operations": [
+		{"op": "create-user", "user": {"name": "alice", "uid": 1000, "home": "/home/alice"}},
+		{"op": "create-user", "user": {"name": "alice", "gid": 1000, "home": "/home/alice"}},
+		{"op": "update-user", "user": {"name": "bob", "uid": 78, "home": "/home/bob"}},
+		{"op": "create-group", "group": {"name": "nogid"}}
+	]}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var plan Plan
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &plan))
+	assert.False(t, plan.Valid)
+	assert.Equal(t, "", plan.Passwd)
+	assert.Equal(t, "", plan.Group)
+	params := map[int]string{}
+	for _, finding := range plan.Findings {
+		assert.Equal(t, codeInvalidParam, finding.Code)
+		params[*finding.Operation] = finding.Param
+	}
+	assert.Equal(t, map[int]string{0: "gid", 1: "uid", 2: "gid", 3: "gid"}, params)
+}
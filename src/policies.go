@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strconv"
+
+	"github.com/graphql-go/graphql"
+	"github.com/labstack/echo"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+	Policies, read from the YAML file given with -policies, limit what callers see: they
+	blank fields (field masks) and drop whole users and groups (row filters). Each role can have
+	a policy, and callers with none of those roles get the default policy. A caller with several
+	roles sees what any of its policies allows, so a field or row is only hidden if every one of
+	its policies hides it. Without -policies, callers see everything.
+*/
+
+var policiesPath string
+
+// Policy is what a role may not see. HideUsers and HideGroups are filters of field names
+// to values, with * wildcards. A filter matches if all of its fields match, and a row is
+// hidden if any filter matches it. 'class' is "system" or "regular", from the -*-range flags.
+type Policy struct {
+	HideFields []string            `yaml:"hide_fields"`
+	HideUsers  []map[string]string `yaml:"hide_users"`
+	HideGroups []map[string]string `yaml:"hide_groups"`
+}
+
+// policiesFile is the format of the -policies file
+type policiesFile struct {
+	Default Policy            `yaml:"default"`
+	Roles   map[string]Policy `yaml:"roles"`
+}
+
+// policies is the loaded -policies file, nil if every caller sees everything
+var policies *policiesFile
+
+// maskableFields are the fields that can be hidden. Names and IDs are always shown,
+// so that responses stay usable as keys.
+var maskableFields = map[string]bool{"comment": true, "home": true, "shell": true, "members": true}
+
+var userFilterFields = map[string]bool{"name": true, "uid": true, "gid": true, "comment": true, "home": true, "shell": true, "class": true}
+var groupFilterFields = map[string]bool{"name": true, "gid": true, "class": true}
+
+// loadPolicies reads and checks the -policies file
+func loadPolicies(configPath string) error {
+	text, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	var config policiesFile
+	if err := yaml.UnmarshalStrict(text, &config); err != nil {
+		return err
+	}
+	if err := checkPolicy("default", config.Default); err != nil {
+		return err
+	}
+	for role, policy := range config.Roles {
+		if err := checkPolicy("role '"+role+"'", policy); err != nil {
+			return err
+		}
+	}
+	policies = &config
+	return nil
+}
+
+func checkPolicy(name string, policy Policy) error {
+	for _, field := range policy.HideFields {
+		if !maskableFields[field] {
+			return fmt.Errorf("%s policy can't hide '%s' - only comment, home, shell and members can be hidden", name, field)
+		}
+	}
+	for kind, filters := range map[string][]map[string]string{"users": policy.HideUsers, "groups": policy.HideGroups} {
+		fields := userFilterFields
+		if kind == "groups" {
+			fields = groupFilterFields
+		}
+		for _, filter := range filters {
+			if len(filter) == 0 {
+				return fmt.Errorf("%s policy has an empty hide_%s filter", name, kind)
+			}
+			for field, pattern := range filter {
+				if !fields[field] {
+					return fmt.Errorf("%s policy can't filter %s by '%s'", name, kind, field)
+				}
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("%s policy has invalid pattern '%s'", name, pattern)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// policySet holds the policies that apply to a caller. An empty set hides nothing.
+type policySet []Policy
+
+// callerPolicies finds the policies of the caller of a request, from its roles
+func callerPolicies(c echo.Context) policySet {
+	if policies == nil {
+		return nil
+	}
+	var set policySet
+	for _, role := range requestCaller(c).Roles {
+		if policy, ok := policies.Roles[role]; ok {
+			set = append(set, policy)
+		}
+	}
+	if len(set) == 0 {
+		set = policySet{policies.Default}
+	}
+	return set
+}
+
+// hidesField checks whether every policy hides a field
+func (set policySet) hidesField(field string) bool {
+	for _, policy := range set {
+		hidden := false
+		for _, hiddenField := range policy.HideFields {
+			hidden = hidden || hiddenField == field
+		}
+		if !hidden {
+			return false
+		}
+	}
+	return len(set) > 0
+}
+
+// hidesRow checks whether every policy has a filter matching the fields of a row
+func (set policySet) hidesRow(fields map[string]string, filtersOf func(Policy) []map[string]string) bool {
+	for _, policy := range set {
+		if !anyFilterMatches(filtersOf(policy), fields) {
+			return false
+		}
+	}
+	return len(set) > 0
+}
+
+func anyFilterMatches(filters []map[string]string, fields map[string]string) bool {
+filters:
+	for _, filter := range filters {
+		for field, pattern := range filter {
+			if ok, _ := path.Match(pattern, fields[field]); !ok {
+				continue filters
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (set policySet) hidesUser(user User) bool {
+	return set.hidesRow(map[string]string{
+		"name":    user.Name,
+		"uid":     strconv.Itoa(user.UID),
+		"gid":     strconv.Itoa(user.GID),
+		"comment": user.Comment,
+		"home":    user.Home,
+		"shell":   user.Shell,
+		"class":   idClass(idRanges["uid/regular"], user.UID),
+	}, func(policy Policy) []map[string]string { return policy.HideUsers })
+}
+
+func (set policySet) hidesGroup(group Group) bool {
+	return set.hidesRow(map[string]string{
+		"name":  group.Name,
+		"gid":   strconv.Itoa(group.GID),
+		"class": idClass(idRanges["gid/regular"], group.GID),
+	}, func(policy Policy) []map[string]string { return policy.HideGroups })
+}
+
+// idClass is "regular" for IDs in the regular range, and "system" for the rest, including root
+func idClass(regular IDRange, id int) string {
+	if id >= regular.Start && id <= regular.End {
+		return "regular"
+	}
+	return "system"
+}
+
+// hidesAnything checks whether the policies can hide anything, so that raw file contents
+// can't be shown
+func (set policySet) hidesAnything() bool {
+	for field := range maskableFields {
+		if set.hidesField(field) {
+			return true
+		}
+	}
+	return set.hidesRows()
+}
+
+// hidesRows checks whether the policies can hide any users or groups, so that the IDs in use
+// can't be shown. Row filters count if every policy has some, even if they don't overlap.
+func (set policySet) hidesRows() bool {
+	if len(set) == 0 {
+		return false
+	}
+	users, groups := true, true
+	for _, policy := range set {
+		users = users && len(policy.HideUsers) > 0
+		groups = groups && len(policy.HideGroups) > 0
+	}
+	return users || groups
+}
+
+// redactUser blanks the fields of a user that the policies hide
+func (set policySet) redactUser(user User) User {
+	if set.hidesField("comment") {
+		user.Comment = ""
+	}
+	if set.hidesField("home") {
+		user.Home = ""
+	}
+	if set.hidesField("shell") {
+		user.Shell = ""
+	}
+	return user
+}
+
+// redactGroup removes hidden users from a group's members, or all of them if members are hidden
+func (set policySet) redactGroup(group Group, hiddenUsers map[string]bool) Group {
+	if len(set) == 0 {
+		return group
+	}
+	members := []string{}
+	if !set.hidesField("members") {
+		for _, member := range groupMembers(group) {
+			if !hiddenUsers[member] {
+				members = append(members, member)
+			}
+		}
+	}
+	group.Members = members
+	return group
+}
+
+// hiddenUserNames lists the names of the users in userDB that the policies hide
+func (set policySet) hiddenUserNames() map[string]bool {
+	hidden := make(map[string]bool)
+	for _, user := range userDB.Query(nil) {
+		if set.hidesUser(user) {
+			hidden[user.Name] = true
+		}
+	}
+	return hidden
+}
+
+// users drops the hidden users from a list, and redacts the rest
+func (set policySet) users(users []User) []User {
+	if len(set) == 0 {
+		return users
+	}
+	out := []User{}
+	for _, user := range users {
+		if !set.hidesUser(user) {
+			out = append(out, set.redactUser(user))
+		}
+	}
+	return out
+}
+
+// groups drops the hidden groups from a list, and redacts the rest
+func (set policySet) groups(groups []Group) []Group {
+	if len(set) == 0 {
+		return groups
+	}
+	hidden := set.hiddenUserNames()
+	out := []Group{}
+	for _, group := range groups {
+		if !set.hidesGroup(group) {
+			out = append(out, set.redactGroup(group, hidden))
+		}
+	}
+	return out
+}
+
+// findUsers returns the users in userDB matching query that the policies show. The query is
+// matched against redacted users, so hidden fields can't be probed with queries.
+func (set policySet) findUsers(query map[string]interface{}) []User {
+	if len(set) == 0 {
+		return userDB.Query(query)
+	}
+	out := []User{}
+	for _, user := range set.users(userDB.Query(nil)) {
+		if query == nil || matchesQuery(query, user) {
+			out = append(out, user)
+		}
+	}
+	return out
+}
+
+// findGroups returns the groups in groupDB matching query that the policies show
+func (set policySet) findGroups(query map[string]interface{}) []Group {
+	if len(set) == 0 {
+		return groupDB.Query(query)
+	}
+	out := []Group{}
+	for _, group := range set.groups(groupDB.Query(nil)) {
+		if query == nil || matchesQuery(query, group) {
+			out = append(out, group)
+		}
+	}
+	return out
+}
+
+// visibleETag picks the ETag to send for a resource. Callers that can't see all of it get the
+// ETag of what they can see, so that it can't be used to confirm guesses of the hidden fields,
+// unless they may write it and need the ETag of the whole resource for If-Match.
+func visibleETag(c echo.Context, redacted bool, fullETag, visibleETag string) string {
+	if !redacted || (writable && (!authEnabled() || requestCaller(c).hasScope(scopeWrite))) {
+		return fullETag
+	}
+	return visibleETag
+}
+
+// searchUsers searches the users that the policies show, so hidden fields and users
+// don't affect the results
+func (set policySet) searchUsers(term string) []User {
+	if len(set) == 0 {
+		return userDB.Search(term)
+	}
+	return rankUsers(set.users(userDB.Query(nil)), term)
+}
+
+// visibleUsers returns the users matching query that the caller of a request may see
+func visibleUsers(c echo.Context, query map[string]interface{}) []User {
+	return callerPolicies(c).findUsers(query)
+}
+
+// visibleGroups returns the groups matching query that the caller of a request may see
+func visibleGroups(c echo.Context, query map[string]interface{}) []Group {
+	return callerPolicies(c).findGroups(query)
+}
+
+// redactedGroup redacts a group written by the caller of a request
+func redactedGroup(c echo.Context, group Group) Group {
+	set := callerPolicies(c)
+	if len(set) == 0 {
+		return group
+	}
+	return set.redactGroup(group, set.hiddenUserNames())
+}
+
+// redactEvent applies the policies to a change event, reporting false if the caller may not
+// see it: if it is about a hidden user, group or member, or only hidden fields changed
+func (set policySet) redactEvent(event ChangeEvent) (ChangeEvent, bool) {
+	if len(set) == 0 {
+		return event, true
+	}
+	var hiddenUsers map[string]bool
+	if event.Group != nil {
+		hiddenUsers = set.hiddenUserNames()
+	}
+	if event.User != nil {
+		if set.hidesUser(*event.User) {
+			return event, false
+		}
+		user := set.redactUser(*event.User)
+		event.User = &user
+	}
+	if event.Group != nil {
+		if set.hidesGroup(*event.Group) {
+			return event, false
+		}
+		if event.Member != "" && (set.hidesField("members") || hiddenUsers[event.Member]) {
+			return event, false
+		}
+		group := set.redactGroup(*event.Group, hiddenUsers)
+		event.Group = &group
+	}
+	switch previous := event.Previous.(type) {
+	case User:
+		if set.hidesUser(previous) || set.redactUser(previous) == *event.User {
+			return event, false
+		}
+		event.Previous = set.redactUser(previous)
+	case Group:
+		previous = set.redactGroup(previous, hiddenUsers)
+		if set.hidesGroup(previous) || reflect.DeepEqual(previous, *event.Group) {
+			return event, false
+		}
+		event.Previous = previous
+	}
+	return event, true
+}
+
+type policiesContextKey struct{}
+
+// gqlPolicies gets the policies of a GraphQL request's caller, stored in its context by runGraphQL
+func gqlPolicies(p graphql.ResolveParams) policySet {
+	set, _ := p.Context.Value(policiesContextKey{}).(policySet)
+	return set
+}
+
+func withPolicies(ctx context.Context, set policySet) context.Context {
+	return context.WithValue(ctx, policiesContextKey{}, set)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicies = `
+default:
+  hide_fields: [comment, home, shell]
+  hide_users:
+    - class: system
+    - name: svc-*
+  hide_groups:
+    - class: system
+roles:
+  auditor:
+    hide_fields: [comment]
+    hide_users:
+      - name: svc-*
+  ops: {}
+`
+
+// usePolicyData replaces the users and groups with a mix of system and regular accounts
+func usePolicyData(t *testing.T) (cleanup func()) {
+	oldUsers, oldGroups := userDB.Query(nil), groupDB.Query(nil)
+	userDB.SetUserList(
+		User{"root", 0, 0, "Root User", "/root", "/bin/bash"},
+		User{"daemon", 1, 1, "daemon", "/usr/sbin", "/usr/sbin/nologin"},
+		User{"alice", 1000, 1000, "Alice Smith,Room 4", "/home/alice", "/bin/bash"},
+		User{"bob", 1001, 1000, "Bob Jones", "/home/bob", "/bin/zsh"},
+		User{"svc-backup", 1002, 1000, "Backups", "/var/backups", "/usr/sbin/nologin"},
+	)
+	groupDB.SetGroupList(
+		Group{"root", 0, []string{"root"}},
+		Group{"sudo", 27, []string{"alice", "daemon"}},
+		Group{"staff", 1000, []string{"alice", "bob", "svc-backup"}},
+		Group{"web", 1001, []string{"bob"}},
+	)
+	return func() {
+		userDB.SetUserList(oldUsers...)
+		groupDB.SetGroupList(oldGroups...)
+	}
+}
+
+func writePolicies(t *testing.T, text string) (cleanup func()) {
+	dir, err := ioutil.TempDir("", "pwaas")
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "policies.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(text), 0600))
+	assert.NoError(t, loadPolicies(path))
+	return func() {
+		os.RemoveAll(dir)
+		policies = nil
+	}
+}
+
+func TestLoadPolicies(t *testing.T) {
+	defer writePolicies(t, testPolicies)()
+	assert.NotNil(t, policies)
+	assert.Len(t, policies.Roles, 2)
+
+	dir, err := ioutil.TempDir("", "pwaas")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policies.yaml")
+	for _, invalid := range []string{
+		"default:\n  hide_fields: [uid]\n",
+		"roles:\n  reader:\n    hide_fields: [password]\n",
+		"default:\n  hide_users:\n    - {}\n",
+		"default:\n  hide_users:\n    - members: root\n",
+		"default:\n  hide_groups:\n    - shell: /bin/false\n",
+		"default:\n  hide_groups:\n    - name: '[web'\n",
+		"default:\n  show_fields: [name]\n",
+	} {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(invalid), 0600))
+		assert.Error(t, loadPolicies(path), invalid)
+	}
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	defer usePolicyData(t)()
+	defer writePolicies(t, testPolicies)()
+	e := newServer()
+	get := func(path string) *httptest.ResponseRecorder {
+		return serveWithKey(e, echo.GET, path, "")
+	}
+	names := func(rec *httptest.ResponseRecorder) (names []string) {
+		var users []User
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &users))
+		for _, user := range users {
+			names = append(names, user.Name)
+		}
+		return
+	}
+
+	// System users and svc-* are hidden, and so are the personal fields of the rest
+	res := get("/v1/users")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.JSONEq(t, `[{"name": "alice", "uid": 1000, "gid": 1000, "comment": "", "home": "", "shell": ""},
+		{"name": "bob", "uid": 1001, "gid": 1000, "comment": "", "home": "", "shell": ""}]`, res.Body.String())
+	assert.Contains(t, res.Header()[echo.HeaderVary], echo.HeaderAuthorization)
+	assert.Equal(t, "private", res.Header().Get("Cache-Control"))
+	assert.Equal(t, []string{"bob"}, names(get("/users/query?uid=1001")))
+	// Hidden fields can't be probed by querying or searching them
+	assert.Empty(t, names(get("/v1/users/query?shell=/bin/bash")))
+	assert.Empty(t, names(get("/v1/users/search?q=smith")))
+	assert.Empty(t, names(get("/v1/users/search?q=backup")))
+	assert.Equal(t, []string{"alice"}, names(get("/v1/users/search?q=alice")))
+	assert.JSONEq(t, `{"": 2}`, get("/v1/users/aggregate?by=shell").Body.String())
+
+	assert.Equal(t, http.StatusNotFound, get("/v1/users/0").Code)
+	assert.Equal(t, http.StatusNotFound, get("/v1/users/1002").Code)
+	res = get("/v1/users/1000")
+	assert.JSONEq(t, `{"name": "alice", "uid": 1000, "gid": 1000, "comment": "", "home": "", "shell": ""}`, res.Body.String())
+	// The ETag is of what the caller sees, so it can't be used to check guesses of hidden fields
+	assert.Equal(t, redactedUserETag(User{Name: "alice", UID: 1000, GID: 1000}), res.Header().Get("ETag"))
+	req := httptest.NewRequest(echo.GET, "/v1/users/1000", nil)
+	req.Header.Set("If-None-Match", userETag(userDB.Query(map[string]interface{}{"uid": 1000})[0]))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, redactedGroupETag(Group{"staff", 1000, []string{"alice", "bob"}}), get("/v1/groups/1000").Header().Get("ETag"))
+
+	rec = serveWrite(e, echo.POST, "/v1/users/batch", `{"keys": ["root", "alice", "1002"]}`)
+	assert.JSONEq(t, `{"root": {"found": false}, "1002": {"found": false}, "alice": {"found": true,
+		"user": {"name": "alice", "uid": 1000, "gid": 1000, "comment": "", "home": "", "shell": ""}}}`, rec.Body.String())
+
+	// Hidden groups and members are left out
+	assert.JSONEq(t, `[{"name": "staff", "gid": 1000, "members": ["alice", "bob"]}]`, get("/v1/users/1000/groups").Body.String())
+	assert.Equal(t, http.StatusNotFound, get("/v1/users/1002/groups").Code)
+	assert.JSONEq(t, `{"uid": 1000, "name": "alice", "group": {"gid": 1000, "name": "staff"},
+		"groups": [{"gid": 1000, "name": "staff"}]}`, get("/v1/users/1000/id").Body.String())
+	assert.Equal(t, http.StatusNotFound, get("/v1/users/1/id").Code)
+	assert.JSONEq(t, `[{"name": "staff", "gid": 1000, "members": ["alice", "bob"]},
+		{"name": "web", "gid": 1001, "members": ["bob"]}]`, get("/v1/groups").Body.String())
+	assert.JSONEq(t, `[{"name": "web", "gid": 1001, "members": ["bob"]}]`, get("/v1/groups/query?name=web").Body.String())
+	assert.JSONEq(t, `[]`, get("/v1/groups/query?name=sudo").Body.String())
+	assert.Equal(t, http.StatusNotFound, get("/v1/groups/27").Code)
+	assert.JSONEq(t, `{"name": "staff", "gid": 1000, "members": ["alice", "bob"]}`, get("/v1/groups/1000").Body.String())
+	rec = serveWrite(e, echo.POST, "/v1/groups/batch", `{"keys": ["sudo", "1001"]}`)
+	assert.JSONEq(t, `{"sudo": {"found": false}, "1001": {"found": true, "group": {"name": "web", "gid": 1001, "members": ["bob"]}}}`, rec.Body.String())
+
+	assert.Equal(t, "alice:x:1000:1000:::\nbob:x:1001:1000:::\n", get("/v1/getent/passwd").Body.String())
+	assert.Equal(t, http.StatusNotFound, get("/v1/getent/passwd/root").Code)
+	assert.Equal(t, "staff:x:1000:alice,bob\nweb:x:1001:bob\n", get("/v1/getent/group").Body.String())
+	assert.Equal(t, http.StatusNotFound, get("/v1/getent/group/sudo").Code)
+
+	var stats Stats
+	assert.NoError(t, json.Unmarshal(get("/v1/stats").Body.Bytes(), &stats))
+	assert.Equal(t, 2, stats.Users)
+	assert.Equal(t, 2, stats.Groups)
+	assert.Equal(t, map[string]int{"": 2}, stats.UsersByShell)
+	var status Status
+	assert.NoError(t, json.Unmarshal(get("/v1/status").Body.Bytes(), &status))
+	assert.Equal(t, 2, status.Users)
+	assert.Equal(t, 2, status.Groups)
+
+	res = get("/v1/graphql?query=" + url.QueryEscape(`{ users { name home } user(uid: 0) { name }
+		group(gid: 1000) { members users { name } primaryUsers { name } } searched: users(search: "nologin") { name } }`))
+	assert.JSONEq(t, `{"data": {"users": [{"name": "alice", "home": ""}, {"name": "bob", "home": ""}], "user": null,
+		"group": {"members": ["alice", "bob"], "users": [{"name": "alice"}, {"name": "bob"}], "primaryUsers": [{"name": "alice"}, {"name": "bob"}]}, "searched": []}}`, res.Body.String())
+}
+
+func TestRolePolicies(t *testing.T) {
+	defer usePolicyData(t)()
+	defer writePolicies(t, testPolicies)()
+	dir, err := ioutil.TempDir("", "pwaas")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func() { apiKeys = nil }()
+	keys := "keys:\n"
+	for name, roles := range map[string]string{"reader": "", "auditor": "auditor", "ops": "ops", "mixed": "auditor, ops"} {
+		keys += "  - name: " + name + "\n    hash: " + keyHash(name) + "\n    scopes: [users:read, groups:read]\n    roles: [" + roles + "]\n"
+	}
+	keys += "  - name: editor\n    hash: " + keyHash("editor") + "\n    scopes: [users:read, groups:read, write]\n    roles: [auditor]\n"
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "keys.yaml"), []byte(keys), 0600))
+	assert.NoError(t, loadAPIKeys(filepath.Join(dir, "keys.yaml")))
+	e := newServer()
+	usersAs := func(key string) (users []User) {
+		rec := serveWithKey(e, echo.GET, "/v1/users", key)
+		assert.Equal(t, http.StatusOK, rec.Code, key)
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &users))
+		return
+	}
+
+	// Keys without a role that has a policy get the default policy
+	assert.Len(t, usersAs("reader"), 2)
+
+	users := usersAs("auditor")
+	assert.Len(t, users, 4)
+	assert.Equal(t, User{"root", 0, 0, "", "/root", "/bin/bash"}, users[0])
+	assert.JSONEq(t, `{"name": "staff", "gid": 1000, "members": ["alice", "bob"]}`, serveWithKey(e, echo.GET, "/v1/groups/1000", "auditor").Body.String())
+
+	// Only callers that can write get the ETag of the whole user, to send as If-Match
+	root := userDB.Query(map[string]interface{}{"uid": 0})[0]
+	assert.Equal(t, redactedUserETag(User{"root", 0, 0, "", "/root", "/bin/bash"}), serveWithKey(e, echo.GET, "/v1/users/0", "auditor").Header().Get("ETag"))
+	assert.Equal(t, redactedUserETag(User{"root", 0, 0, "", "/root", "/bin/bash"}), serveWithKey(e, echo.GET, "/v1/users/0", "editor").Header().Get("ETag"))
+	writable = true
+	defer func() { writable = false }()
+	assert.Equal(t, userETag(root), serveWithKey(e, echo.GET, "/v1/users/0", "editor").Header().Get("ETag"))
+	assert.Equal(t, userETag(root), serveWithKey(e, echo.GET, "/v1/users/0", "ops").Header().Get("ETag"))
+
+	assert.Len(t, usersAs("ops"), 5)
+	assert.Equal(t, "Root User", usersAs("ops")[0].Comment)
+
+	// Free IDs would show the IDs of hidden users, so only callers that see every user and group get them
+	rec := serveWithKey(e, echo.GET, "/v1/ids/free?kind=uid", "auditor")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, codeRestrictedByPolicy, parseProblem(t, rec.Body.Bytes()).Code)
+	assert.Equal(t, http.StatusForbidden, serveWithKey(e, echo.POST, "/v1/ids/allocate?kind=uid", "editor").Code)
+	assert.Equal(t, http.StatusOK, serveWithKey(e, echo.GET, "/v1/ids/free?kind=uid", "ops").Code)
+
+	// With several roles, whatever any of them shows is shown
+	users = usersAs("mixed")
+	assert.Len(t, users, 5)
+	assert.Equal(t, "Backups", users[4].Comment)
+}
+
+func TestPolicyRedactsWrites(t *testing.T) {
+	_, cleanup := useTempPasswdFile(t)
+	defer cleanup()
+	defer writePolicies(t, testPolicies)()
+	writable = true
+	defer func() { writable = false }()
+	e := newServer()
+
+	rec := serveWrite(e, echo.POST, "/v1/users", `{"name": "carol", "uid": 1005, "gid": 1005, "comment": "Carol", "home": "/home/carol", "shell": "/bin/sh"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.JSONEq(t, `{"name": "carol", "uid": 1005, "gid": 1005, "comment": "", "home": "", "shell": ""}`, rec.Body.String())
+	// The file has the whole user, and the ETag matches it
+	assert.Equal(t, "/home/carol", userDB.Query(map[string]interface{}{"uid": 1005})[0].Home)
+	assert.Equal(t, userETag(User{"carol", 1005, 1005, "Carol", "/home/carol", "/bin/sh"}), rec.Header().Get("ETag"))
+
+	rec = serveWrite(e, echo.POST, "/v1/groups", `{"name": "carols", "gid": 1005, "members": ["carol", "root"]}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.JSONEq(t, `{"name": "carols", "gid": 1005, "members": ["carol"]}`, rec.Body.String())
+
+	// Plans show whole lines, so they are refused to callers whose policy hides anything
+	plan := `{"operations": [{"op": "delete-user", "uid": 1005}]}`
+	rec = serveWrite(e, echo.POST, "/v1/plan", plan)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, codeRestrictedByPolicy, parseProblem(t, rec.Body.Bytes()).Code)
+	defer writePolicies(t, "default:\n  hide_groups:\n    - class: system\nroles:\n  ops: {}\n")()
+	assert.Equal(t, http.StatusForbidden, serveWrite(e, echo.POST, "/v1/plan", plan).Code)
+	defer writePolicies(t, "default: {}\nroles:\n  ops:\n    hide_fields: [shell]\n")()
+	assert.Equal(t, http.StatusOK, serveWrite(e, echo.POST, "/v1/plan", plan).Code)
+}
+
+func TestEventStreamPolicies(t *testing.T) {
+	_, cleanup := useTempPasswdFile(t)
+	defer cleanup()
+	defer writePolicies(t, testPolicies)()
+	server := httptest.NewServer(newServer())
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/v1/events")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/ws", nil)
+	assert.NoError(t, err)
+	defer ws.Close()
+
+	// bob is a system user, so changes to him are hidden, as is the new svc-web
+	passwd, _ := ioutil.ReadFile(passwdFilePath)
+	passwd = []byte(strings.Replace(string(passwd), "/bin/bash", "/bin/zsh", -1))
+	passwd = append([]byte("svc-web:x:1500:1500:Web:/srv/web:/bin/sh\nzoe:x:1501:1501:Zoe Q:/home/zoe:/bin/sh\n"), passwd...)
+	assert.NoError(t, ioutil.WriteFile(passwdFilePath, passwd, 0644))
+	assert.True(t, reloadAll().OK)
+	redacted := User{Name: "zoe", UID: 1501, GID: 1501}
+
+	var event ChangeEvent
+	lines := bufio.NewScanner(res.Body)
+	for lines.Scan() {
+		if line := lines.Text(); strings.HasPrefix(line, "data: ") {
+			assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+			break
+		}
+	}
+	assert.Equal(t, eventUserAdded, event.Type)
+	assert.Equal(t, redacted, *event.User)
+
+	var wsEvent ChangeEvent
+	assert.NoError(t, ws.ReadJSON(&wsEvent))
+	assert.Equal(t, event.ID, wsEvent.ID)
+	assert.Equal(t, redacted, *wsEvent.User)
+}
+
+func TestRedactEvent(t *testing.T) {
+	defer usePolicyData(t)()
+	defer writePolicies(t, testPolicies)()
+	set := policySet{policies.Default}
+	alice := User{"alice", 1000, 1000, "Alice Smith", "/home/alice", "/bin/bash"}
+	moved, system := alice, alice
+	moved.Home = "/srv/alice"
+	system.UID = 500
+	staff := Group{"staff", 1000, []string{"alice", "bob", "svc-backup"}}
+
+	event, ok := set.redactEvent(ChangeEvent{Type: eventUserAdded, User: &alice})
+	assert.True(t, ok)
+	assert.Equal(t, User{Name: "alice", UID: 1000, GID: 1000}, *event.User)
+	// Changes to hidden fields only aren't sent
+	_, ok = set.redactEvent(ChangeEvent{Type: eventUserModified, User: &moved, Previous: alice})
+	assert.False(t, ok)
+	_, ok = set.redactEvent(ChangeEvent{Type: eventUserModified, User: &alice, Previous: system})
+	assert.False(t, ok)
+	_, ok = set.redactEvent(ChangeEvent{Type: eventMemberAdded, Group: &staff, Member: "svc-backup"})
+	assert.False(t, ok)
+	event, ok = set.redactEvent(ChangeEvent{Type: eventMemberAdded, Group: &staff, Member: "bob"})
+	assert.True(t, ok)
+	assert.Equal(t, []string{"alice", "bob"}, event.Group.Members)
+	_, ok = set.redactEvent(ChangeEvent{Type: eventGroupAdded, Group: &Group{"sudo", 27, []string{"alice"}}})
+	assert.False(t, ok)
+	// Events are passed through untouched without policies
+	event, ok = policySet(nil).redactEvent(ChangeEvent{Type: eventUserAdded, User: &alice})
+	assert.True(t, ok)
+	assert.Equal(t, alice, *event.User)
+}
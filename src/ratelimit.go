@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+	Rate limits, read from the YAML file given with -rate-limits, are token buckets per client:
+	a client can make up to burst requests at once, and then rate requests per second. Clients
+	are told apart by API key, or by IP address if they don't send one. Routes listed in the
+	file have buckets of their own, and all other routes share the default bucket.
+
+	Expensive routes can also have a concurrency limit, the number of requests served at once
+	across all clients, so that a burst from many clients can't tie up every CPU.
+*/
+
+var rateLimitsPath string
+
+// RateLimit is the limit of a route. Without a rate, the route shares the default bucket.
+type RateLimit struct {
+	Rate        float64 `yaml:"rate"`
+	Burst       int     `yaml:"burst"`
+	Concurrency int     `yaml:"concurrency"`
+}
+
+// rateLimitsFile is the format of the -rate-limits file. Routes are keyed like routeDocs.
+type rateLimitsFile struct {
+	Default RateLimit            `yaml:"default"`
+	Routes  map[string]RateLimit `yaml:"routes"`
+}
+
+// staleBucketSweep is how often buckets that have refilled are forgotten, so that
+// clients that have gone away don't use memory
+const staleBucketSweep = time.Minute
+
+// tokenBucket holds the tokens left to a client, as of last
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	limit  RateLimit
+}
+
+// refill adds the tokens earned since the bucket was last used
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+}
+
+// untilTokens is how long until the bucket has n tokens, rounded up to a whole second
+func (b *tokenBucket) untilTokens(n float64) int {
+	return int(math.Ceil((n - b.tokens) / b.limit.Rate))
+}
+
+type rateLimiter struct {
+	limits  rateLimitsFile
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+	// slots are semaphores for the routes with a concurrency limit
+	slots map[string]chan struct{}
+}
+
+// limiter is the loaded -rate-limits file, nil if requests aren't limited
+var limiter *rateLimiter
+
+// loadRateLimits reads and checks the -rate-limits file
+func loadRateLimits(configPath string) error {
+	text, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	var config rateLimitsFile
+	if err := yaml.UnmarshalStrict(text, &config); err != nil {
+		return err
+	}
+	if config.Default.Concurrency != 0 {
+		return fmt.Errorf("concurrency can only be limited per route")
+	}
+	if config.Default, err = checkRateLimit("default", config.Default); err != nil {
+		return err
+	}
+	slots := make(map[string]chan struct{})
+	for route, limit := range config.Routes {
+		if _, ok := routeDocs[route]; !ok {
+			return fmt.Errorf("unknown route '%s' - routes look like 'GET /users/search'", route)
+		}
+		if config.Routes[route], err = checkRateLimit("route '"+route+"'", limit); err != nil {
+			return err
+		}
+		if limit.Concurrency > 0 {
+			slots[route] = make(chan struct{}, limit.Concurrency)
+		}
+	}
+	limiter = &rateLimiter{limits: config, buckets: make(map[string]*tokenBucket), swept: time.Now(), slots: slots}
+	return nil
+}
+
+// checkRateLimit validates a limit, defaulting the burst to one second's worth of requests
+func checkRateLimit(name string, limit RateLimit) (RateLimit, error) {
+	if limit.Rate < 0 || limit.Burst < 0 || limit.Concurrency < 0 {
+		return limit, fmt.Errorf("%s limits can't be negative", name)
+	}
+	if limit.Rate == 0 && limit.Burst > 0 {
+		return limit, fmt.Errorf("%s has a burst without a rate", name)
+	}
+	if limit.Rate > 0 && limit.Burst == 0 {
+		limit.Burst = int(math.Max(1, math.Ceil(limit.Rate)))
+	}
+	return limit, nil
+}
+
+// take takes a token from the bucket of a client, reporting whether there was one
+func (l *rateLimiter) take(key string, limit RateLimit, now time.Time) (bool, *tokenBucket) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if now.Sub(l.swept) > staleBucketSweep {
+		for bucketKey, bucket := range l.buckets {
+			if bucket.refill(now); bucket.tokens >= float64(bucket.limit.Burst) {
+				delete(l.buckets, bucketKey)
+			}
+		}
+		l.swept = now
+	}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now, limit: limit}
+		l.buckets[key] = bucket
+	}
+	bucket.refill(now)
+	allowed := bucket.tokens >= 1
+	if allowed {
+		bucket.tokens--
+	}
+	// Return a copy, since the bucket can change once the lock is released
+	state := *bucket
+	return allowed, &state
+}
+
+// rateLimitClient identifies who a request counts against: the name of its API key, or its IP address.
+// X-Forwarded-For isn't trusted, since any client could set it.
+func rateLimitClient(c echo.Context) string {
+	if key, ok := lookupAPIKey(c); ok {
+		return "key:" + key.Name
+	}
+	host, _, err := net.SplitHostPort(c.Request().RemoteAddr)
+	if err != nil {
+		host = c.Request().RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// rateLimit rejects requests from clients that have used up their bucket with 429, and requests
+// to routes already serving their concurrency limit with 503. Responses have RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers, as in the IETF RateLimit header fields draft.
+func rateLimit(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if limiter == nil {
+			return next(c)
+		}
+		route := c.Request().Method + " " + strings.TrimPrefix(c.Path(), apiVersionPrefix)
+		limit, bucketKey := limiter.limits.Routes[route], route
+		if limit.Rate == 0 {
+			limit, bucketKey = limiter.limits.Default, "default"
+		}
+		if limit.Rate > 0 {
+			allowed, bucket := limiter.take(bucketKey+" "+rateLimitClient(c), limit, time.Now())
+			header := c.Response().Header()
+			header.Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+			header.Set("RateLimit-Remaining", strconv.Itoa(int(bucket.tokens)))
+			header.Set("RateLimit-Reset", strconv.Itoa(bucket.untilTokens(float64(limit.Burst))))
+			if !allowed {
+				header.Set("Retry-After", strconv.Itoa(bucket.untilTokens(1)))
+				return &APIError{
+					Status: http.StatusTooManyRequests,
+					Code:   codeRateLimited,
+					Detail: fmt.Sprintf("Too many requests - the limit is %g per second", limit.Rate),
+				}
+			}
+		}
+		if slots, ok := limiter.slots[route]; ok {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			default:
+				c.Response().Header().Set("Retry-After", "1")
+				return &APIError{
+					Status: http.StatusServiceUnavailable,
+					Code:   codeTooBusy,
+					Detail: fmt.Sprintf("Already serving %d requests to %s - try again shortly", cap(slots), route),
+				}
+			}
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeRateLimits(t *testing.T, text string) (cleanup func()) {
+	dir, err := ioutil.TempDir("", "pwaas")
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "limits.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(text), 0600))
+	assert.NoError(t, loadRateLimits(path))
+	return func() {
+		os.RemoveAll(dir)
+		limiter = nil
+	}
+}
+
+func serveFrom(e *echo.Echo, path, remoteAddr, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(echo.GET, path, nil)
+	req.RemoteAddr = remoteAddr
+	if key != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+key)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestLoadRateLimits(t *testing.T) {
+	defer writeRateLimits(t, "default:\n  rate: 2.5\nroutes:\n  GET /users/search:\n    rate: 1\n    burst: 5\n    concurrency: 2\n")()
+	assert.Equal(t, RateLimit{Rate: 2.5, Burst: 3}, limiter.limits.Default)
+	assert.Equal(t, 2, cap(limiter.slots["GET /users/search"]))
+
+	dir, err := ioutil.TempDir("", "pwaas")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "limits.yaml")
+	for _, invalid := range []string{
+		"default:\n  rate: -1\n",
+		"default:\n  burst: 5\n",
+		"default:\n  rate: 1\n  concurrency: 5\n",
+		"routes:\n  GET /v1/users/search:\n    rate: 1\n",
+		"routes:\n  GET /nowhere:\n    rate: 1\n",
+		"routes:\n  GET /stats:\n    concurrency: -1\n",
+		"default:\n  requests: 10\n",
+	} {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(invalid), 0600))
+		assert.Error(t, loadRateLimits(path), invalid)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	defer writeRateLimits(t, `
+default:
+  rate: 1
+  burst: 3
+routes:
+  GET /users/search:
+    rate: 0.5
+    burst: 1
+`)()
+	e := newServer()
+
+	for i, remaining := range []string{"2", "1", "0"} {
+		rec := serveFrom(e, "/v1/users", "192.0.2.1:1234", "")
+		assert.Equal(t, http.StatusOK, rec.Code, i)
+		assert.Equal(t, "3", rec.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, remaining, rec.Header().Get("RateLimit-Remaining"))
+		assert.NotEmpty(t, rec.Header().Get("RateLimit-Reset"))
+	}
+	// Unlisted routes share the default bucket, including the unversioned ones
+	rec := serveFrom(e, "/users", "192.0.2.1:5678", "")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, codeRateLimited, parseProblem(t, rec.Body.Bytes()).Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, http.StatusTooManyRequests, serveFrom(e, "/v1/groups", "192.0.2.1:1234", "").Code)
+
+	// Listed routes have a bucket of their own
+	rec = serveFrom(e, "/v1/users/search?q=bob", "192.0.2.1:1234", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("RateLimit-Limit"))
+	rec = serveFrom(e, "/v1/users/search?q=bob", "192.0.2.1:1234", "")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+
+	// Other clients aren't affected
+	assert.Equal(t, http.StatusOK, serveFrom(e, "/v1/users", "192.0.2.2:1234", "").Code)
+	assert.Equal(t, http.StatusOK, serveFrom(e, "/v1/users/search?q=bob", "192.0.2.2:1234", "").Code)
+	// and clients with an API key are limited by key rather than by IP
+	dir, err := ioutil.TempDir("", "pwaas")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func() { apiKeys = nil }()
+	writeAPIKeys(t, filepath.Join(dir, "keys.yaml"), map[string]string{"batch": "users:read"})
+	assert.NoError(t, loadAPIKeys(filepath.Join(dir, "keys.yaml")))
+	assert.Equal(t, http.StatusOK, serveFrom(e, "/v1/users", "192.0.2.1:1234", "batch").Code)
+	assert.Equal(t, "1", serveFrom(e, "/v1/users", "192.0.2.3:1234", "batch").Header().Get("RateLimit-Remaining"))
+}
+
+func TestTokenBucket(t *testing.T) {
+	defer writeRateLimits(t, "default:\n  rate: 2\n  burst: 2\n")()
+	limit := limiter.limits.Default
+	start := time.Now()
+
+	for _, allowed := range []bool{true, true, false} {
+		ok, _ := limiter.take("default ip:192.0.2.1", limit, start)
+		assert.Equal(t, allowed, ok)
+	}
+	// Tokens come back at the rate, up to the burst
+	ok, bucket := limiter.take("default ip:192.0.2.1", limit, start.Add(500*time.Millisecond))
+	assert.True(t, ok)
+	assert.Equal(t, 0.0, bucket.tokens)
+	assert.Equal(t, 1, bucket.untilTokens(2))
+	_, bucket = limiter.take("default ip:192.0.2.1", limit, start.Add(time.Hour))
+	assert.Equal(t, 1.0, bucket.tokens)
+
+	// Buckets that have refilled are forgotten
+	limiter.take("default ip:192.0.2.2", limit, start.Add(time.Hour))
+	assert.Len(t, limiter.buckets, 2)
+	limiter.take("default ip:192.0.2.3", limit, start.Add(time.Hour+2*staleBucketSweep))
+	assert.Len(t, limiter.buckets, 1)
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	defer writeRateLimits(t, "routes:\n  GET /stats:\n    concurrency: 1\n")()
+	e := newServer()
+
+	// Responses without a rate limit have no RateLimit headers
+	rec := serveFrom(e, "/v1/stats", "192.0.2.1:1234", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("RateLimit-Limit"))
+
+	// Hold the only slot, as a slow request would
+	limiter.slots["GET /stats"] <- struct{}{}
+	rec = serveFrom(e, "/v1/stats", "192.0.2.1:1234", "")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, codeTooBusy, parseProblem(t, rec.Body.Bytes()).Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	// Other routes aren't limited
+	assert.Equal(t, http.StatusOK, serveFrom(e, "/v1/users", "192.0.2.1:1234", "").Code)
+
+	<-limiter.slots["GET /stats"]
+	assert.Equal(t, http.StatusOK, serveFrom(e, "/v1/stats", "192.0.2.1:1234", "").Code)
+	assert.Len(t, limiter.slots["GET /stats"], 0)
+}
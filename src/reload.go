@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// ReloadResult reports what a forced reload of the passwd and group files did.
+// If a file can't be read or parsed, its last good data is kept and the error is reported.
+type ReloadResult struct {
+	OK       bool   `json:"ok"`
+	Users    int    `json:"users"`
+	Groups   int    `json:"groups"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+	// Coalesced is true if this request shared a reload queued by another request
+	Coalesced bool `json:"coalesced"`
+}
+
+// reloadCall is a reload, which concurrent requests wait for instead of starting their own
+type reloadCall struct {
+	done   chan struct{}
+	result ReloadResult
+}
+
+// currentReload is the reload running, and nextReload the one that will run after it, if any
+var currentReload, nextReload *reloadCall
+var reloadLock sync.Mutex
+
+// reloadAll re-reads both files, even if they look unchanged - for example after restoring
+// a backup with the same mtime. The running reload may have read the files before the
+// caller's change, so calls made while a reload is running wait for the next one, which
+// they all share.
+func reloadAll() ReloadResult {
+	reloadLock.Lock()
+	running, call := currentReload, nextReload
+	if running == nil {
+		call = &reloadCall{done: make(chan struct{})}
+		currentReload = call
+		reloadLock.Unlock()
+		runReload(call)
+		return call.result
+	}
+	if call != nil {
+		reloadLock.Unlock()
+		<-call.done
+		result := call.result
+		result.Coalesced = true
+		return result
+	}
+	// The first caller to queue a reload runs it once the running one is done
+	call = &reloadCall{done: make(chan struct{})}
+	nextReload = call
+	reloadLock.Unlock()
+	<-running.done
+	reloadLock.Lock()
+	currentReload, nextReload = call, nil
+	reloadLock.Unlock()
+	runReload(call)
+	return call.result
+}
+
+// runReload runs the current reload. If another is queued, the finished reload stays current
+// until the queued one starts, so that nothing else starts a reload in between.
+func runReload(call *reloadCall) {
+	call.result = readAllFiles()
+	reloadLock.Lock()
+	if nextReload == nil {
+		currentReload = nil
+	}
+	reloadLock.Unlock()
+	close(call.done)
+}
+
+func readAllFiles() ReloadResult {
+	start := time.Now()
+	result := ReloadResult{OK: true}
+	if err := readPasswdFile(); err != nil {
+		result.OK = false
+		result.Error = "passwd: " + err.Error()
+	}
+	if err := readGroupFile(); err != nil {
+		if !result.OK {
+			result.Error += "; "
+		}
+		result.OK = false
+		result.Error += "group: " + err.Error()
+	}
+	result.Users = len(userDB.Query(nil))
+	result.Groups = len(groupDB.Query(nil))
+	result.Duration = time.Since(start).String()
+	return result
+}
+
+// reloadData forces a reload of the passwd and group files
+func reloadData(c echo.Context) error {
+	return c.JSON(http.StatusOK, reloadAll())
+}
+
+// handleReloadSignals reloads the files whenever pwaas receives SIGHUP, like most daemons.
+// stop stops handling the signal, and returns once any reload it started has finished.
+func handleReloadSignals() (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-signals:
+			}
+			result := reloadAll()
+			if result.OK {
+				log.Printf("SIGHUP: reloaded %d users and %d groups in %s", result.Users, result.Groups, result.Duration)
+			} else {
+				log.Println("SIGHUP: reload failed:", result.Error)
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+		<-stopped
+	}
+}
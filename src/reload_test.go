@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func serveReload(e *echo.Echo, auth string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(echo.POST, "/v1/admin/reload", nil)
+	if auth != "" {
+		req.Header.Set(echo.HeaderAuthorization, auth)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminReload(t *testing.T) {
+	_, cleanup := useTempPasswdFile(t)
+	defer cleanup()
+	e := newServer()
+
+	rec := serveReload(e, "Bearer secret")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, codeAdminDisabled, parseProblem(t, rec.Body.Bytes()).Code)
+
+	adminToken = "secret"
+	defer func() { adminToken = "" }()
+	for _, auth := range []string{"", "secret", "Bearer wrong", "Basic c2VjcmV0"} {
+		rec = serveReload(e, auth)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, auth)
+		assert.Equal(t, "Bearer", rec.Header().Get(echo.HeaderWWWAuthenticate))
+	}
+
+	// Reloads even though nothing notified pwaas of the change
+	info, _ := os.Stat(passwdFilePath)
+	assert.NoError(t, ioutil.WriteFile(passwdFilePath, []byte("alice:x:1000:1000::/home/alice:/bin/sh\n"), 0644))
+	assert.NoError(t, os.Chtimes(passwdFilePath, info.ModTime(), info.ModTime()))
+	rec = serveReload(e, "Bearer secret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var result ReloadResult
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.True(t, result.OK)
+	assert.Equal(t, 1, result.Users)
+	assert.Equal(t, 2, result.Groups)
+	assert.NotEmpty(t, result.Duration)
+	assert.False(t, result.Coalesced)
+
+	// Parse errors are reported, and the last good data is kept
+	assert.NoError(t, ioutil.WriteFile(groupFilePath, []byte("broken\n"), 0644))
+	rec = serveReload(e, "Bearer secret")
+	result = ReloadResult{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.False(t, result.OK)
+	assert.Contains(t, result.Error, "group: ")
+	assert.Equal(t, 2, result.Groups)
+}
+
+func TestReloadCoalescing(t *testing.T) {
+	_, cleanup := useTempPasswdFile(t)
+	defer cleanup()
+	// Pretend a reload is already running, which read the files before they changed
+	running := &reloadCall{done: make(chan struct{}), result: ReloadResult{OK: true, Users: 7}}
+	reloadLock.Lock()
+	currentReload = running
+	reloadLock.Unlock()
+	assert.NoError(t, ioutil.WriteFile(passwdFilePath, []byte("alice:x:1000:1000::/home/alice:/bin/sh\n"), 0644))
+	results := make(chan ReloadResult)
+	for i := 0; i < 3; i++ {
+		go func() { results <- reloadAll() }()
+	}
+	eventually(t, func() bool {
+		reloadLock.Lock()
+		defer reloadLock.Unlock()
+		return nextReload != nil
+	}, "a queued reload")
+	close(running.done)
+
+	// Callers wait for a reload that starts after the running one, and share it
+	coalesced := 0
+	for i := 0; i < 3; i++ {
+		result := <-results
+		assert.True(t, result.OK)
+		assert.Equal(t, 1, result.Users)
+		if result.Coalesced {
+			coalesced++
+		}
+	}
+	assert.True(t, coalesced > 0)
+	reloadLock.Lock()
+	assert.Nil(t, currentReload)
+	assert.Nil(t, nextReload)
+	reloadLock.Unlock()
+}
+
+func TestReloadSignal(t *testing.T) {
+	_, cleanup := useTempPasswdFile(t)
+	defer cleanup()
+	stop := handleReloadSignals()
+	// Stopped before cleanup, so a reload can't read the file paths while they're reset
+	defer stop()
+	assert.NoError(t, ioutil.WriteFile(passwdFilePath, []byte("carol:x:1001:1001::/home/carol:/bin/sh\n"), 0644))
+	assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	eventually(t, hasUser("carol"), "the SIGHUP reload")
+}
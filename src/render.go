@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+	Responses can be rendered in several formats. The format is picked from the
+	?format= URL param if given, otherwise from the Accept header, and defaults to JSON.
+
+	json	application/json (?pretty indents it)
+	ndjson	application/x-ndjson - one JSON value per line, one line per list item
+	csv		text/csv - a header row of JSON field names, then one row per item
+	yaml	application/yaml
+	passwd	text/plain - passwd file lines, for users only
+	group	text/plain - group file lines, for groups only
+*/
+
+const (
+	mimeNDJSON = "application/x-ndjson"
+	mimeCSV    = "text/csv"
+	mimeYAML   = "application/yaml"
+)
+
+// acceptFormats maps Accept header media types to response formats
+var acceptFormats = map[string]string{
+	"application/json":   "json",
+	"application/*":      "json",
+	"*/*":                "json",
+	mimeNDJSON:           "ndjson",
+	"application/ndjson": "ndjson",
+	mimeCSV:              "csv",
+	mimeYAML:             "yaml",
+	"application/x-yaml": "yaml",
+	"text/yaml":          "yaml",
+}
+
+var renderFormats = map[string]bool{
+	"json": true, "ndjson": true, "csv": true, "yaml": true, "passwd": true, "group": true,
+}
+
+// responseFormat picks the format to render a response in
+func responseFormat(c echo.Context) (string, error) {
+	if format := c.QueryParam("format"); format != "" {
+		if !renderFormats[format] {
+			return "", badRequest(codeUnsupportedFormat, "format", fmt.Sprintf("'%s' is not a supported format", format))
+		}
+		return format, nil
+	}
+	for _, mediaType := range parseAccept(c.Request().Header.Get(echo.HeaderAccept)) {
+		if format, ok := acceptFormats[mediaType]; ok {
+			return format, nil
+		}
+	}
+	return "json", nil
+}
+
+// parseAccept returns the media types in an Accept header, most preferred first
+func parseAccept(header string) []string {
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		r := mediaRange{mediaType: strings.ToLower(strings.TrimSpace(params[0])), q: 1}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					r.q = q
+				}
+			}
+		}
+		if r.mediaType != "" && r.q > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	out := make([]string, len(ranges))
+	for i, r := range ranges {
+		out[i] = r.mediaType
+	}
+	return out
+}
+
+// render writes data in the format requested by the client
+func render(c echo.Context, code int, data interface{}) error {
+	format, err := responseFormat(c)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "ndjson":
+		body, err := renderNDJSON(data)
+		if err != nil {
+			return err
+		}
+		return c.Blob(code, mimeNDJSON, body)
+	case "csv":
+		body, err := renderCSV(data)
+		if err != nil {
+			return err
+		}
+		return c.Blob(code, mimeCSV+"; charset=utf-8", body)
+	case "yaml":
+		body, err := yaml.Marshal(yamlValue(reflect.ValueOf(data)))
+		if err != nil {
+			return err
+		}
+		return c.Blob(code, mimeYAML, body)
+	case "passwd", "group":
+		body, ok := renderLines(format, data)
+		if !ok {
+			return &APIError{
+				Status: http.StatusNotAcceptable,
+				Code:   codeNotAcceptable,
+				Param:  "format",
+				Detail: fmt.Sprintf("This endpoint can't be rendered as %s lines", format),
+			}
+		}
+		return c.String(code, body)
+	}
+	return c.JSON(code, data)
+}
+
+// renderNDJSON writes each item of a list on its own line, or a single value on one line
+func renderNDJSON(data interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	val := reflect.ValueOf(data)
+	if val.Kind() != reflect.Slice {
+		err := encoder.Encode(data)
+		return buf.Bytes(), err
+	}
+	for i := 0; i < val.Len(); i++ {
+		if err := encoder.Encode(val.Index(i).Interface()); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// renderCSV writes lists and single values of flat structs (like User and Group) as a table.
+// Maps of scalars become key,value rows, and anything else is flattened into field,value rows.
+func renderCSV(data interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	val := reflect.Indirect(reflect.ValueOf(data))
+	switch {
+	case val.Kind() == reflect.Slice && isFlatStruct(val.Type().Elem()):
+		writer.Write(jsonFieldNames(val.Type().Elem()))
+		for i := 0; i < val.Len(); i++ {
+			writer.Write(csvRow(val.Index(i)))
+		}
+	case val.Kind() == reflect.Struct && isFlatStruct(val.Type()):
+		writer.Write(jsonFieldNames(val.Type()))
+		writer.Write(csvRow(val))
+	case val.Kind() == reflect.Map && isScalar(val.Type().Elem()):
+		writer.Write([]string{"key", "value"})
+		for _, key := range sortedKeys(val) {
+			writer.Write([]string{fmt.Sprint(key.Interface()), csvCell(val.MapIndex(key))})
+		}
+	default:
+		writer.Write([]string{"field", "value"})
+		flattenValue("", val, func(field, value string) {
+			writer.Write([]string{field, value})
+		})
+	}
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
+
+// renderLines writes users as passwd lines or groups as group lines
+func renderLines(format string, data interface{}) (string, bool) {
+	var lines strings.Builder
+	switch v := data.(type) {
+	case []User:
+		if format != "passwd" {
+			return "", false
+		}
+		for _, user := range v {
+			lines.WriteString(formatPasswdLine(user) + "\n")
+		}
+	case User:
+		if format != "passwd" {
+			return "", false
+		}
+		lines.WriteString(formatPasswdLine(v) + "\n")
+	case []Group:
+		if format != "group" {
+			return "", false
+		}
+		for _, group := range v {
+			lines.WriteString(formatGroupLine(group) + "\n")
+		}
+	case Group:
+		if format != "group" {
+			return "", false
+		}
+		lines.WriteString(formatGroupLine(v) + "\n")
+	default:
+		return "", false
+	}
+	return lines.String(), true
+}
+
+// jsonName returns the name a struct field has in JSON, or "" if it isn't serialized
+func jsonName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "-" || field.PkgPath != "" {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// jsonFieldNames returns the JSON names of a struct's fields, in declaration order
+func jsonFieldNames(t reflect.Type) (names []string) {
+	for i := 0; i < t.NumField(); i++ {
+		if name := jsonName(t.Field(i)); name != "" {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+func isScalar(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// isFlatStruct is true for structs whose fields are all scalars or lists of scalars
+func isFlatStruct(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		ft := t.Field(i).Type
+		if !isScalar(ft) && !(ft.Kind() == reflect.Slice && isScalar(ft.Elem())) {
+			return false
+		}
+	}
+	return true
+}
+
+func csvRow(val reflect.Value) (row []string) {
+	for i := 0; i < val.NumField(); i++ {
+		if jsonName(val.Type().Field(i)) != "" {
+			row = append(row, csvCell(val.Field(i)))
+		}
+	}
+	return
+}
+
+// csvCell stringifies a value, joining lists with commas like the group file does
+func csvCell(val reflect.Value) string {
+	if val.Kind() == reflect.Slice {
+		items := make([]string, val.Len())
+		for i := range items {
+			items[i] = fmt.Sprint(val.Index(i).Interface())
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(val.Interface())
+}
+
+func sortedKeys(val reflect.Value) []reflect.Value {
+	keys := val.MapKeys()
+	sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface()) })
+	return keys
+}
+
+// flattenValue calls emit with a dotted path for every scalar inside val
+func flattenValue(path string, val reflect.Value, emit func(field, value string)) {
+	join := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+	switch val.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if val.IsNil() {
+			emit(path, "")
+			return
+		}
+		flattenValue(path, val.Elem(), emit)
+	case reflect.Struct:
+		for i := 0; i < val.NumField(); i++ {
+			if name := jsonName(val.Type().Field(i)); name != "" {
+				flattenValue(join(name), val.Field(i), emit)
+			}
+		}
+	case reflect.Map:
+		for _, key := range sortedKeys(val) {
+			flattenValue(join(fmt.Sprint(key.Interface())), val.MapIndex(key), emit)
+		}
+	case reflect.Slice:
+		for i := 0; i < val.Len(); i++ {
+			flattenValue(join(strconv.Itoa(i)), val.Index(i), emit)
+		}
+	default:
+		emit(path, fmt.Sprint(val.Interface()))
+	}
+}
+
+// yamlValue converts val into something yaml.Marshal will write with the same
+// field names and order as the JSON encoding
+func yamlValue(val reflect.Value) interface{} {
+	switch val.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if val.IsNil() {
+			return nil
+		}
+		return yamlValue(val.Elem())
+	case reflect.Struct:
+		out := yaml.MapSlice{}
+		for i := 0; i < val.NumField(); i++ {
+			field := val.Type().Field(i)
+			name := jsonName(field)
+			if name == "" {
+				continue
+			}
+			if strings.Contains(field.Tag.Get("json"), ",omitempty") && isEmptyValue(val.Field(i)) {
+				continue
+			}
+			out = append(out, yaml.MapItem{Key: name, Value: yamlValue(val.Field(i))})
+		}
+		return out
+	case reflect.Map:
+		out := yaml.MapSlice{}
+		for _, key := range sortedKeys(val) {
+			out = append(out, yaml.MapItem{Key: fmt.Sprint(key.Interface()), Value: yamlValue(val.MapIndex(key))})
+		}
+		return out
+	case reflect.Slice:
+		out := make([]interface{}, val.Len())
+		for i := range out {
+			out[i] = yamlValue(val.Index(i))
+		}
+		return out
+	case reflect.Invalid:
+		return nil
+	}
+	return val.Interface()
+}
+
+func isEmptyValue(val reflect.Value) bool {
+	switch val.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+		return val.IsNil() || (val.Kind() != reflect.Ptr && val.Kind() != reflect.Interface && val.Len() == 0)
+	case reflect.String:
+		return val.Len() == 0
+	case reflect.Int, reflect.Int64:
+		return val.Int() == 0
+	case reflect.Bool:
+		return !val.Bool()
+	}
+	return false
+}
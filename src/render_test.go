@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func mockAcceptRequest(endpoint, accept string, handler func(c echo.Context) error) (code int, contentType, body string) {
+	e := echo.New()
+	req := httptest.NewRequest(echo.GET, endpoint, nil)
+	req.Header.Set(echo.HeaderAccept, accept)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	if err := handler(c); err != nil {
+		httpErrorHandler(err, c)
+	}
+	return rec.Code, rec.Header().Get(echo.HeaderContentType), rec.Body.String()
+}
+
+func TestParseAccept(t *testing.T) {
+	assert.Equal(t, []string{"text/csv", "application/json"}, parseAccept("application/json;q=0.5, text/csv"))
+	assert.Equal(t, []string{"text/html"}, parseAccept("text/html, application/json;q=0"))
+	assert.Len(t, parseAccept(""), 0)
+}
+
+func TestRenderFormats(t *testing.T) {
+	passwdFilePath = passwdTestFile
+	assert.NoError(t, readPasswdFile())
+	groupFilePath = "../sample_files/group.test.txt"
+	assert.NoError(t, readGroupFile())
+
+	code, contentType, body := mockAcceptRequest("/users", "text/csv", getUsers)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, contentType, mimeCSV)
+	assert.Equal(t, "name,uid,gid,comment,home,shell\n"+
+		"bob,78,78,Bob Jones,/home/bob,/bin/bash\n"+
+		"root,0,0,Root User,/root,/bin/bash\n", body)
+
+	_, _, body = mockAcceptRequest("/groups?format=csv", "application/json", getGroups)
+	assert.Equal(t, "name,gid,members\nmygroup,24,\"bob,root\"\nadmin,80,root\n", body)
+
+	_, contentType, body = mockAcceptRequest("/users/query?uid=78", mimeNDJSON, queryUsers)
+	assert.Equal(t, mimeNDJSON, contentType)
+	assert.Equal(t, `{"name":"bob","uid":78,"gid":78,"comment":"Bob Jones","home":"/home/bob","shell":"/bin/bash"}`+"\n", body)
+
+	_, contentType, body = mockAcceptRequest("/users/search?q=root&format=yaml", "", searchUsers)
+	assert.Equal(t, mimeYAML, contentType)
+	assert.Equal(t, "- name: root\n  uid: 0\n  gid: 0\n  comment: Root User\n  home: /root\n  shell: /bin/bash\n", body)
+
+	_, _, body = mockAcceptRequest("/users?format=passwd", "", getUsers)
+	assert.Equal(t, "bob:x:78:78:Bob Jones:/home/bob:/bin/bash\nroot:x:0:0:Root User:/root:/bin/bash\n", body)
+	_, _, body = mockAcceptRequest("/groups?format=group", "", getGroups)
+	assert.Equal(t, "mygroup:x:24:bob,root\nadmin:x:80:root\n", body)
+	code, _, _ = mockAcceptRequest("/groups?format=passwd", "", getGroups)
+	assert.Equal(t, http.StatusNotAcceptable, code)
+	code, _, _ = mockAcceptRequest("/groups?format=xml", "", getGroups)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	_, _, body = mockAcceptRequest("/stats?format=csv", "", getStats)
+	assert.Contains(t, body, "field,value\nusers,2\ngroups,2\nusers_by_shell./bin/bash,2\n")
+	_, _, body = mockAcceptRequest("/stats", "application/yaml", getStats)
+	assert.Contains(t, body, "users: 2\ngroups: 2\nusers_by_shell:\n  /bin/bash: 2\n")
+
+	// JSON is the default, and ?pretty still indents it
+	_, contentType, body = mockAcceptRequest("/groups/query?gid=80&pretty", "text/html", queryGroups)
+	assert.Contains(t, contentType, echo.MIMEApplicationJSON)
+	assert.Contains(t, body, "[\n  {\n    \"name\": \"admin\",\n    \"gid\": 80,")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+// largestGroupCount is how many groups are listed in Stats.LargestGroups
+const largestGroupCount = 5
+
+// IDRange is an inclusive range of UIDs or GIDs
+type IDRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// IDUsage describes which IDs are in use, and the unused gaps between them
+type IDUsage struct {
+	Min    int       `json:"min"`
+	Max    int       `json:"max"`
+	Ranges []IDRange `json:"ranges"`
+	Gaps   []IDRange `json:"gaps"`
+}
+
+// GroupSize is a group name and its member count
+type GroupSize struct {
+	Name    string `json:"name"`
+	GID     int    `json:"gid"`
+	Members int    `json:"members"`
+}
+
+// Stats is a summary of the users and groups in the database
+type Stats struct {
+	Users              int            `json:"users"`
+	Groups             int            `json:"groups"`
+	UsersByShell       map[string]int `json:"users_by_shell"`
+	UsersByGID         map[string]int `json:"users_by_gid"`
+	UsersByHomePrefix  map[string]int `json:"users_by_home_prefix"`
+	GroupSizeHistogram map[string]int `json:"group_size_histogram"`
+	EmptyGroups        []string       `json:"empty_groups"`
+	LargestGroups      []GroupSize    `json:"largest_groups"`
+	UIDs               IDUsage        `json:"uids"`
+	GIDs               IDUsage        `json:"gids"`
+}
+
+// buildStats computes Stats from a list of users and groups
+func buildStats(users []User, groups []Group) Stats {
+	stats := Stats{
+		Users:              len(users),
+		Groups:             len(groups),
+		UsersByShell:       make(map[string]int),
+		UsersByGID:         make(map[string]int),
+		UsersByHomePrefix:  make(map[string]int),
+		GroupSizeHistogram: make(map[string]int),
+		EmptyGroups:        []string{},
+		LargestGroups:      []GroupSize{},
+	}
+	var uids, gids []int
+	for _, user := range users {
+		stats.UsersByShell[user.Shell]++
+		stats.UsersByGID[fmt.Sprint(user.GID)]++
+		stats.UsersByHomePrefix[path.Dir(user.Home)]++
+		uids = append(uids, user.UID)
+	}
+	var sizes []GroupSize
+	for _, group := range groups {
+		size := GroupSize{Name: group.Name, GID: group.GID, Members: len(groupMembers(group))}
+		stats.GroupSizeHistogram[fmt.Sprint(size.Members)]++
+		if size.Members == 0 {
+			stats.EmptyGroups = append(stats.EmptyGroups, group.Name)
+		}
+		sizes = append(sizes, size)
+		gids = append(gids, group.GID)
+	}
+	sort.SliceStable(sizes, func(i, j int) bool { return sizes[i].Members > sizes[j].Members })
+	for i := 0; i < len(sizes) && i < largestGroupCount && sizes[i].Members > 0; i++ {
+		stats.LargestGroups = append(stats.LargestGroups, sizes[i])
+	}
+	stats.UIDs = idUsage(uids)
+	stats.GIDs = idUsage(gids)
+	return stats
+}
+
+// groupMembers returns the member names of a group, ignoring the empty name
+// parseGroups produces for a group with no members
+func groupMembers(group Group) (members []string) {
+	for _, member := range group.Members {
+		if member != "" {
+			members = append(members, member)
+		}
+	}
+	return
+}
+
+// idUsage collapses a list of IDs into contiguous ranges and the gaps between them
+func idUsage(ids []int) (usage IDUsage) {
+	usage.Ranges = []IDRange{}
+	usage.Gaps = []IDRange{}
+	if len(ids) == 0 {
+		return
+	}
+	sorted := make([]int, len(ids))
+	copy(sorted, ids)
+	sort.Ints(sorted)
+	usage.Min = sorted[0]
+	usage.Max = sorted[len(sorted)-1]
+	current := IDRange{Start: sorted[0], End: sorted[0]}
+	for _, id := range sorted[1:] {
+		if id <= current.End+1 {
+			if id > current.End {
+				current.End = id
+			}
+			continue
+		}
+		usage.Ranges = append(usage.Ranges, current)
+		usage.Gaps = append(usage.Gaps, IDRange{Start: current.End + 1, End: id - 1})
+		current = IDRange{Start: id, End: id}
+	}
+	usage.Ranges = append(usage.Ranges, current)
+	return
+}
+
+// aggregateUsers counts users by the stringified value of the field with the given JSON name
+func aggregateUsers(users []User, fieldName string) (map[string]int, error) {
+	if _, ok := fieldByJSONName(User{}, fieldName); !ok {
+		return nil, badRequest(codeInvalidParam, "by", fmt.Sprintf("'%s' is not a user field", fieldName))
+	}
+	out := make(map[string]int)
+	for _, user := range users {
+		field, _ := fieldByJSONName(user, fieldName)
+		out[fmt.Sprint(field.Interface())]++
+	}
+	return out, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDUsage(t *testing.T) {
+	usage := idUsage([]int{5, 1, 2, 3, 3, 9, 10})
+	assert.Equal(t, 1, usage.Min)
+	assert.Equal(t, 10, usage.Max)
+	assert.Equal(t, []IDRange{{1, 3}, {5, 5}, {9, 10}}, usage.Ranges)
+	assert.Equal(t, []IDRange{{4, 4}, {6, 8}}, usage.Gaps)
+
+	usage = idUsage(nil)
+	assert.Len(t, usage.Ranges, 0)
+	assert.Len(t, usage.Gaps, 0)
+}
+
+func TestBuildStats(t *testing.T) {
+	empty := Group{Name: "nobody", GID: 25, Members: []string{""}}
+	stats := buildStats([]User{testUser1, testUser2}, []Group{testGroup1, testGroup2, empty})
+	assert.Equal(t, 2, stats.Users)
+	assert.Equal(t, 3, stats.Groups)
+	assert.Equal(t, map[string]int{"/bin/bash": 2}, stats.UsersByShell)
+	assert.Equal(t, map[string]int{"78": 1, "0": 1}, stats.UsersByGID)
+	assert.Equal(t, map[string]int{"/home": 1, "/": 1}, stats.UsersByHomePrefix)
+	assert.Equal(t, map[string]int{"2": 1, "1": 1, "0": 1}, stats.GroupSizeHistogram)
+	assert.Equal(t, []string{"nobody"}, stats.EmptyGroups)
+	assert.Equal(t, "mygroup", stats.LargestGroups[0].Name)
+	assert.Len(t, stats.LargestGroups, 2)
+	assert.Equal(t, []IDRange{{24, 25}, {80, 80}}, stats.GIDs.Ranges)
+}
+
+func TestStatsEndpoints(t *testing.T) {
+	passwdFilePath = passwdTestFile
+	assert.NoError(t, readPasswdFile())
+	groupFilePath = "../sample_files/group.test.txt"
+	assert.NoError(t, readGroupFile())
+
+	code, body := mockRequest("/stats", getStats)
+	assert.Equal(t, http.StatusOK, code)
+	var stats Stats
+	assert.NoError(t, json.Unmarshal(body, &stats))
+	assert.Equal(t, 2, stats.Users)
+	assert.Equal(t, 2, stats.Groups)
+
+	code, body = mockRequest("/users/aggregate?by=shell", aggregateUsersBy)
+	assert.Equal(t, http.StatusOK, code)
+	var counts map[string]int
+	assert.NoError(t, json.Unmarshal(body, &counts))
+	assert.Equal(t, map[string]int{"/bin/bash": 2}, counts)
+
+	code, _ = mockRequest("/users/aggregate?by=password", aggregateUsersBy)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = mockRequest("/users/aggregate", aggregateUsersBy)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// maxDataAge is how long the data can go without matching the files on disk before
+// /readyz fails. Zero means no limit.
+var maxDataAge time.Duration
+
+// Status describes the state of the server, for operators
+type Status struct {
+	Ready bool `json:"ready"`
+	// DataAge is how long since the served data was last known to match the files
+	DataAge          string         `json:"data_age,omitempty"`
+	Users            int            `json:"users"`
+	Groups           int            `json:"groups"`
+	Files            []FileStatus   `json:"files"`
+	LastReload       *ReloadOutcome `json:"last_reload,omitempty"`
+	LastFailedReload *ReloadOutcome `json:"last_failed_reload,omitempty"`
+	Watch            WatchStatus    `json:"watch"`
+}
+
+// FileStatus describes one of the files being served
+type FileStatus struct {
+	Path    string    `json:"path"`
+	ModTime time.Time `json:"mtime,omitempty"`
+	// Hash is the SHA-256 of the file now, and LoadedHash of the contents being served.
+	// They differ if the file has changed and not been reloaded.
+	Hash       string `json:"hash,omitempty"`
+	LoadedHash string `json:"loaded_hash,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// ReloadOutcome is when a file was read, and the error if it couldn't be loaded
+type ReloadOutcome struct {
+	Path  string    `json:"path"`
+	At    time.Time `json:"at"`
+	Error string    `json:"error,omitempty"`
+}
+
+// Readiness is all that /status shows to callers without users:read and groups:read,
+// when authentication is enabled, since the rest describes the server's files
+type Readiness struct {
+	Ready bool `json:"ready"`
+}
+
+// loadState is what's known about the data loaded from one file
+type loadState struct {
+	hash string
+	// verified is the last time the file was known to match hash
+	verified time.Time
+	// checked is the file as last hashed, so it's only hashed again if its mtime or size change
+	checked fileCheck
+}
+
+type fileCheck struct {
+	modTime time.Time
+	size    int64
+	hash    string
+}
+
+var loadStates = map[string]*loadState{}
+var lastReload, lastFailedReload *ReloadOutcome
+var loadStatesLock sync.Mutex
+
+// recordLoad notes the outcome of reading a file, for /status and /readyz. info is the file
+// as opened for reading.
+func recordLoad(path string, contents hash.Hash, info os.FileInfo, err error) {
+	loadStatesLock.Lock()
+	defer loadStatesLock.Unlock()
+	outcome := &ReloadOutcome{Path: path, At: time.Now()}
+	if err != nil {
+		outcome.Error = err.Error()
+		lastFailedReload = outcome
+		return
+	}
+	lastReload = outcome
+	sum := hex.EncodeToString(contents.Sum(nil))
+	loadStates[path] = &loadState{hash: sum, verified: outcome.At, checked: fileCheck{info.ModTime(), info.Size(), sum}}
+}
+
+// fileHash is the SHA-256 of a file's current contents
+func fileHash(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// checkFiles compares the files on disk with the data loaded from them. A file that still
+// matches counts as verified now, so data that hasn't changed never goes stale. Files are only
+// hashed again if their mtime or size have changed since they were last hashed.
+// It returns the status of each file, the age of the oldest data, and false if a file was never loaded.
+func checkFiles(now time.Time) (files []FileStatus, age time.Duration, loaded bool) {
+	loaded = true
+	for _, path := range []string{passwdFilePath, groupFilePath} {
+		file := FileStatus{Path: path}
+		loadStatesLock.Lock()
+		state := loadStates[path]
+		var checked fileCheck
+		if state != nil {
+			checked = state.checked
+		}
+		loadStatesLock.Unlock()
+
+		info, err := os.Stat(path)
+		if err == nil {
+			file.ModTime = info.ModTime()
+			if info.ModTime().Equal(checked.modTime) && info.Size() == checked.size {
+				file.Hash = checked.hash
+			} else if file.Hash, err = fileHash(path); err == nil {
+				checked = fileCheck{info.ModTime(), info.Size(), file.Hash}
+			}
+		}
+		if err != nil {
+			file.Error = err.Error()
+		}
+
+		loadStatesLock.Lock()
+		if state == nil {
+			loaded = false
+		} else {
+			file.LoadedHash = state.hash
+			state.checked = checked
+			if file.Hash == state.hash {
+				state.verified = now
+			}
+			if fileAge := now.Sub(state.verified); fileAge > age {
+				age = fileAge
+			}
+		}
+		loadStatesLock.Unlock()
+		files = append(files, file)
+	}
+	return
+}
+
+// readiness checks that the data has been loaded, and is no older than maxDataAge
+func readiness(age time.Duration, loaded bool) error {
+	if !loaded {
+		return notReady("The passwd and group files haven't been loaded yet")
+	}
+	if maxDataAge > 0 && age > maxDataAge {
+		return notReady(fmt.Sprintf("The data hasn't matched the files for %s, more than the max of %s", age, maxDataAge))
+	}
+	return nil
+}
+
+// getStatus reports the state of the server. When authentication is enabled, callers without
+// users:read and groups:read only get Readiness.
+func getStatus(c echo.Context) error {
+	files, age, loaded := checkFiles(time.Now())
+	if caller := authenticate(c); authEnabled() && !(caller.hasScope(scopeUsersRead) && caller.hasScope(scopeGroupsRead)) {
+		return c.JSON(http.StatusOK, Readiness{Ready: readiness(age, loaded) == nil})
+	}
+	status := Status{
+		Ready:  readiness(age, loaded) == nil,
+		Users:  len(visibleUsers(c, nil)),
+		Groups: len(visibleGroups(c, nil)),
+		Files:  files,
+		Watch:  watchStatus(),
+	}
+	if loaded {
+		status.DataAge = age.Round(time.Millisecond).String()
+	}
+	loadStatesLock.Lock()
+	status.LastReload, status.LastFailedReload = lastReload, lastFailedReload
+	loadStatesLock.Unlock()
+	return c.JSON(http.StatusOK, status)
+}
+
+// livez reports that the server is up, regardless of the state of the data
+func livez(c echo.Context) error {
+	return c.String(http.StatusOK, "OK")
+}
+
+// readyz reports whether the server has fresh data to serve
+func readyz(c echo.Context) error {
+	_, age, loaded := checkFiles(time.Now())
+	if err := readiness(age, loaded); err != nil {
+		return err
+	}
+	return c.String(http.StatusOK, "OK")
+}
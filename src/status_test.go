@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestStatus(t *testing.T, e *echo.Echo) (status Status) {
+	rec := serveWrite(e, echo.GET, "/v1/status", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	return
+}
+
+func TestStatus(t *testing.T) {
+	_, cleanup := useTempPasswdFile(t)
+	defer cleanup()
+	maxDataAge = 20 * time.Millisecond
+	defer func() { maxDataAge = 0 }()
+	e := newServer()
+
+	status := getTestStatus(t, e)
+	assert.True(t, status.Ready)
+	assert.Equal(t, 2, status.Users)
+	assert.Equal(t, 2, status.Groups)
+	assert.Len(t, status.Files, 2)
+	for _, file := range status.Files {
+		assert.NotEmpty(t, file.Hash)
+		assert.Equal(t, file.Hash, file.LoadedHash)
+		assert.False(t, file.ModTime.IsZero())
+	}
+	assert.Equal(t, groupFilePath, status.LastReload.Path)
+	assert.Equal(t, http.StatusOK, serveWrite(e, echo.GET, "/v1/livez", "").Code)
+
+	// Files are only hashed again when their mtime or size change
+	info, err := os.Stat(passwdFilePath)
+	assert.NoError(t, err)
+	text, err := ioutil.ReadFile(passwdFilePath)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(passwdFilePath, []byte(strings.Replace(string(text), "bob", "rob", 1)), 0644))
+	assert.NoError(t, os.Chtimes(passwdFilePath, info.ModTime(), info.ModTime()))
+	assert.Equal(t, status.Files[0].Hash, getTestStatus(t, e).Files[0].Hash)
+	assert.NoError(t, ioutil.WriteFile(passwdFilePath, text, 0644))
+	assert.NotEqual(t, status.Files[0].ModTime, getTestStatus(t, e).Files[0].ModTime)
+	assert.Equal(t, status.Files[0].Hash, getTestStatus(t, e).Files[0].Hash)
+	assert.Equal(t, http.StatusOK, serveWrite(e, echo.GET, "/v1/readyz", "").Code)
+
+	// Unchanged data doesn't go stale, however long ago it was loaded
+	time.Sleep(2 * maxDataAge)
+	assert.Equal(t, http.StatusOK, serveWrite(e, echo.GET, "/v1/readyz", "").Code)
+
+	// A file that changed but can't be loaded does
+	assert.NoError(t, ioutil.WriteFile(groupFilePath, []byte("broken\n"), 0644))
+	assert.Error(t, readGroupFile())
+	assert.Equal(t, http.StatusOK, serveWrite(e, echo.GET, "/v1/readyz", "").Code)
+	time.Sleep(2 * maxDataAge)
+	rec := serveWrite(e, echo.GET, "/v1/readyz", "")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, codeNotReady, parseProblem(t, rec.Body.Bytes()).Code)
+	assert.Equal(t, http.StatusOK, serveWrite(e, echo.GET, "/v1/livez", "").Code)
+
+	status = getTestStatus(t, e)
+	assert.False(t, status.Ready)
+	assert.Equal(t, 2, status.Groups)
+	assert.NotEqual(t, status.Files[1].Hash, status.Files[1].LoadedHash)
+	assert.Equal(t, groupFilePath, status.LastFailedReload.Path)
+	assert.Contains(t, status.LastFailedReload.Error, "groups parse error")
+
+	assert.NoError(t, ioutil.WriteFile(groupFilePath, []byte("staff:x:50:\n"), 0644))
+	assert.NoError(t, readGroupFile())
+	assert.Equal(t, http.StatusOK, serveWrite(e, echo.GET, "/v1/readyz", "").Code)
+
+	// Data that was never loaded isn't ready
+	saved := loadStates
+	loadStates = map[string]*loadState{}
+	defer func() { loadStates = saved }()
+	assert.Equal(t, http.StatusServiceUnavailable, serveWrite(e, echo.GET, "/v1/readyz", "").Code)
+	assert.Empty(t, getTestStatus(t, e).DataAge)
+}
+
+func TestStatusAuth(t *testing.T) {
+	dir, cleanup := useTempPasswdFile(t)
+	defer cleanup()
+	defer func() { apiKeys = nil }()
+	writeAPIKeys(t, filepath.Join(dir, "keys.yaml"), map[string]string{"monitor": "users:read, groups:read", "batch": "users:read"})
+	assert.NoError(t, loadAPIKeys(filepath.Join(dir, "keys.yaml")))
+	e := newServer()
+
+	// Without the read scopes, /status only says whether the server is ready
+	for _, key := range []string{"", "batch"} {
+		rec := serveWithKey(e, echo.GET, "/v1/status", key)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `{"ready": true}`, rec.Body.String())
+	}
+	var status Status
+	rec := serveWithKey(e, echo.GET, "/v1/status", "monitor")
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.Len(t, status.Files, 2)
+	assert.NotEmpty(t, status.Files[0].Hash)
+}
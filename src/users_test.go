@@ -3,12 +3,12 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -139,20 +139,57 @@ func TestUserEndpoints(t *testing.T) {
 	assert.Equal(t, testUser1, users[0])
 }
 
+func TestBatchUsers(t *testing.T) {
+	passwdFilePath = passwdTestFile
+	assert.NoError(t, readPasswdFile())
+
+	code, body := mockBodyRequest(echo.POST, "/users/batch", `{"keys": [78, "root", "0", "nobody", 5]}`, batchUsers)
+	assert.Equal(t, http.StatusOK, code)
+	var results map[string]UserBatchResult
+	assert.NoError(t, json.Unmarshal(body, &results))
+	assert.Len(t, results, 5)
+	assert.Equal(t, testUser1, *results["78"].User)
+	assert.Equal(t, testUser2, *results["root"].User)
+	assert.Equal(t, testUser2, *results["0"].User)
+	assert.False(t, results["nobody"].Found)
+	assert.Nil(t, results["nobody"].User)
+	assert.False(t, results["5"].Found)
+
+	code, _ = mockBodyRequest(echo.POST, "/users/batch", `{"keys": []}`, batchUsers)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = mockBodyRequest(echo.POST, "/users/batch", `{"keys": [true]}`, batchUsers)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = mockBodyRequest(echo.POST, "/users/batch", `not json`, batchUsers)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
 func mockRequest(endpoint string, handler func(c echo.Context) error) (code int, body []byte) {
 	e := echo.New()
 	req := httptest.NewRequest(echo.GET, endpoint, nil)
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
-	err := handler(c)
-	if err != nil {
-		fmt.Println(err)
+	if err := handler(c); err != nil {
+		httpErrorHandler(err, c)
 	}
 	code = rec.Code
 	body = rec.Body.Bytes()
 	return
 }
 
+func mockBodyRequest(method, endpoint, body string, handler func(c echo.Context) error) (code int, respBody []byte) {
+	e := echo.New()
+	req := httptest.NewRequest(method, endpoint, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	if err := handler(c); err != nil {
+		httpErrorHandler(err, c)
+	}
+	code = rec.Code
+	respBody = rec.Body.Bytes()
+	return
+}
+
 func mockParamRequest(endpoint, path, paramname, paramvalue string, handler func(c echo.Context) error) (code int, body []byte) {
 	e := echo.New()
 	req := httptest.NewRequest(echo.GET, endpoint, nil)
@@ -161,9 +198,8 @@ func mockParamRequest(endpoint, path, paramname, paramvalue string, handler func
 	c.SetPath(path)
 	c.SetParamNames(paramname)
 	c.SetParamValues(paramvalue)
-	err := handler(c)
-	if err != nil {
-		fmt.Println(err)
+	if err := handler(c); err != nil {
+		httpErrorHandler(err, c)
 	}
 	code = rec.Code
 	body = rec.Body.Bytes()
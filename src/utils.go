@@ -1,8 +1,9 @@
 package main
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
+	"io"
 	"strconv"
 
 	"github.com/labstack/echo"
@@ -10,17 +11,18 @@ import (
 
 // Parses and validates query params into a valid query map
 // Query params are in the URL like ?uid=123&name=root
+// Errors are *APIError, naming the offending parameter
 func parseQueryParams(params map[string][]string) (map[string]interface{}, error) {
 	out := make(map[string]interface{})
 	for k, v := range params {
 		if k == "member" {
 			out["members"] = v
 		} else if len(v) > 1 {
-			return nil, fmt.Errorf("'%s' has too many query parameters", k)
+			return nil, badRequest(codeTooManyValues, k, fmt.Sprintf("'%s' has too many query parameters", k))
 		} else if k == "uid" || k == "gid" {
 			intVal, err := strconv.Atoi(v[0])
 			if err != nil {
-				return nil, fmt.Errorf("'%s' must be an integer", k)
+				return nil, badRequest(codeInvalidParam, k, fmt.Sprintf("'%s' must be an integer", k))
 			}
 			out[k] = intVal
 		} else {
@@ -28,7 +30,7 @@ func parseQueryParams(params map[string][]string) (map[string]interface{}, error
 		}
 	}
 	if len(out) == 0 {
-		return nil, errors.New("Query cannot be empty")
+		return nil, badRequest(codeEmptyQuery, "", "Query cannot be empty")
 	}
 	return out, nil
 }
@@ -42,3 +44,62 @@ func paramsMap(c echo.Context) map[string][]string {
 	}
 	return out
 }
+
+// maxBatchSize caps the number of keys accepted by the batch endpoints
+const maxBatchSize = 10000
+
+// BatchRequest is the body of a batch lookup. Keys may be numeric IDs or names.
+type BatchRequest struct {
+	Keys []interface{} `json:"keys"`
+}
+
+// Reads the keys of a batch lookup from a JSON request body like {"keys": [0, "root"]}
+// Keys are returned as strings - numeric keys are matched against IDs, the rest against names
+func parseBatchKeys(body io.Reader) ([]string, error) {
+	var req BatchRequest
+	decoder := json.NewDecoder(body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&req); err != nil {
+		return nil, badRequest(codeInvalidBody, "", "Request body must be a JSON object with a 'keys' list")
+	}
+	if len(req.Keys) == 0 {
+		return nil, badRequest(codeInvalidBody, "keys", "'keys' cannot be empty")
+	}
+	if len(req.Keys) > maxBatchSize {
+		return nil, badRequest(codeInvalidBody, "keys", fmt.Sprintf("'keys' cannot contain more than %d entries", maxBatchSize))
+	}
+	out := make([]string, len(req.Keys))
+	for i, key := range req.Keys {
+		switch k := key.(type) {
+		case json.Number:
+			out[i] = k.String()
+		case string:
+			out[i] = k
+		default:
+			return nil, badRequest(codeInvalidBody, "keys", "'keys' must only contain IDs and names")
+		}
+	}
+	return out, nil
+}
+
+// Finds the first user whose UID (for numeric keys) or name matches key
+func findUserByKey(users []User, key string) (User, bool) {
+	uid, err := strconv.Atoi(key)
+	for _, user := range users {
+		if (err == nil && user.UID == uid) || (err != nil && user.Name == key) {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+// Finds the first group whose GID (for numeric keys) or name matches key
+func findGroupByKey(groups []Group, key string) (Group, bool) {
+	gid, err := strconv.Atoi(key)
+	for _, group := range groups {
+		if (err == nil && group.GID == gid) || (err != nil && group.Name == key) {
+			return group, true
+		}
+	}
+	return Group{}, false
+}
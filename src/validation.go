@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// namePattern matches valid user and group names, as accepted by useradd and groupadd
+var namePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]{0,31}\$?$`)
+
+// requireFields checks that a JSON object has the required fields, since a missing ID would
+// otherwise decode as 0, which is root's
+func requireFields(body json.RawMessage, required ...string) error {
+	var fields map[string]json.RawMessage
+	json.Unmarshal(body, &fields)
+	for _, field := range required {
+		if _, ok := fields[field]; !ok {
+			return badRequest(codeInvalidParam, field, fmt.Sprintf("'%s' is required", field))
+		}
+	}
+	return nil
+}
+
+// validateUser checks that a user can be written to a passwd file
+func validateUser(user User) error {
+	if !namePattern.MatchString(user.Name) {
+		return badRequest(codeInvalidParam, "name", fmt.Sprintf("'%s' is not a valid user name", user.Name))
+	}
+	if user.UID < 0 {
+		return badRequest(codeInvalidParam, "uid", "'uid' cannot be negative")
+	}
+	if user.GID < 0 {
+		return badRequest(codeInvalidParam, "gid", "'gid' cannot be negative")
+	}
+	fields := map[string]string{"comment": user.Comment, "home": user.Home, "shell": user.Shell}
+	for _, param := range []string{"comment", "home", "shell"} {
+		if strings.ContainsAny(fields[param], ":\n") {
+			return badRequest(codeInvalidParam, param, fmt.Sprintf("'%s' cannot contain ':' or newlines", param))
+		}
+	}
+	if !path.IsAbs(user.Home) {
+		return badRequest(codeInvalidParam, "home", "'home' must be an absolute path")
+	}
+	if user.Shell != "" && !path.IsAbs(user.Shell) {
+		return badRequest(codeInvalidParam, "shell", "'shell' must be an absolute path")
+	}
+	return nil
+}
+
+// validateGroup checks that a group can be written to a group file
+func validateGroup(group Group) error {
+	if !namePattern.MatchString(group.Name) {
+		return badRequest(codeInvalidParam, "name", fmt.Sprintf("'%s' is not a valid group name", group.Name))
+	}
+	if group.GID < 0 {
+		return badRequest(codeInvalidParam, "gid", "'gid' cannot be negative")
+	}
+	for _, member := range group.Members {
+		if !namePattern.MatchString(member) {
+			return badRequest(codeInvalidParam, "members", fmt.Sprintf("'%s' is not a valid user name", member))
+		}
+	}
+	return nil
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
 
 	"github.com/labstack/echo"
 )
@@ -10,72 +14,412 @@ func healthCheck(c echo.Context) error {
 	return c.String(http.StatusOK, "OK")
 }
 
+func getStats(c echo.Context) error {
+	return render(c, http.StatusOK, buildStats(visibleUsers(c, nil), visibleGroups(c, nil)))
+}
+
+// graphqlHandler executes GraphQL queries sent as a JSON POST body or in the 'query' URL param
+func graphqlHandler(c echo.Context) error {
+	var req GraphQLRequest
+	if c.Request().Method == http.MethodPost {
+		if err := c.Bind(&req); err != nil {
+			return badRequest(codeInvalidBody, "", "Request body must be a JSON object with a 'query'")
+		}
+	} else {
+		req.Query = c.QueryParam("query")
+		req.OperationName = c.QueryParam("operationName")
+	}
+	if req.Query == "" {
+		return badRequest(codeEmptyQuery, "query", "'query' cannot be empty")
+	}
+	return c.JSON(http.StatusOK, runGraphQL(req, callerPolicies(c)))
+}
+
 /***** USER ENDPOINTS *****/
 
 func getUsers(c echo.Context) error {
-	return c.JSON(http.StatusOK, userDB.Query(nil))
+	return render(c, http.StatusOK, visibleUsers(c, nil))
 }
 
 func queryUsers(c echo.Context) error {
 	query, err := parseQueryParams(c.QueryParams())
 	if err != nil {
-		return c.String(http.StatusBadRequest, err.Error())
+		return err
 	}
-	return c.JSON(http.StatusOK, userDB.Query(query))
+	return render(c, http.StatusOK, visibleUsers(c, query))
 }
 
 func searchUsers(c echo.Context) error {
 	term := c.QueryParam("q")
-	return c.JSON(http.StatusOK, userDB.Search(term))
+	return render(c, http.StatusOK, callerPolicies(c).searchUsers(term))
+}
+
+func aggregateUsersBy(c echo.Context) error {
+	field := c.QueryParam("by")
+	if field == "" {
+		return badRequest(codeInvalidParam, "by", "'by' is required")
+	}
+	result, err := aggregateUsers(visibleUsers(c, nil), field)
+	if err != nil {
+		return err
+	}
+	return render(c, http.StatusOK, result)
 }
 
 func getUserByUID(c echo.Context) error {
 	query, err := parseQueryParams(paramsMap(c))
 	if err != nil {
-		return c.String(http.StatusBadRequest, err.Error())
+		return err
 	}
 	result := userDB.Query(query)
-	if len(result) == 0 {
-		return c.String(http.StatusNotFound, "User not found")
+	set := callerPolicies(c)
+	if len(result) == 0 || set.hidesUser(result[0]) {
+		return errUserNotFound
+	}
+	user := set.redactUser(result[0])
+	if resourceNotModified(c, visibleETag(c, user != result[0], userETag(result[0]), redactedUserETag(user))) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return render(c, http.StatusOK, user)
+}
+
+// UserBatchResult is the outcome of looking up a single key in a user batch
+type UserBatchResult struct {
+	Found bool  `json:"found"`
+	User  *User `json:"user,omitempty"`
+}
+
+// batchUsers resolves a list of UIDs and names to users in a single request
+// All keys are resolved against the same copy of the database, so a reload mid-request can't mix results
+func batchUsers(c echo.Context) error {
+	keys, err := parseBatchKeys(c.Request().Body)
+	if err != nil {
+		return err
+	}
+	byUID := make(map[int]User)
+	byName := make(map[string]User)
+	users := visibleUsers(c, nil)
+	// Iterate backwards so the first entry wins for duplicate UIDs, like getUserByUID
+	for i := len(users) - 1; i >= 0; i-- {
+		byUID[users[i].UID] = users[i]
+		byName[users[i].Name] = users[i]
+	}
+	out := make(map[string]UserBatchResult, len(keys))
+	for _, key := range keys {
+		user, ok := byName[key]
+		if uid, err := strconv.Atoi(key); err == nil {
+			user, ok = byUID[uid]
+		}
+		if ok {
+			out[key] = UserBatchResult{Found: true, User: &user}
+		} else {
+			out[key] = UserBatchResult{Found: false}
+		}
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// requireWritable rejects requests to endpoints that modify files unless pwaas was started with -writable
+func requireWritable(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !writable {
+			return errReadOnly
+		}
+		return next(c)
+	}
+}
+
+// decodeUser reads a User from a JSON request body into user, checking that the required
+// fields are in the body
+func decodeUser(c echo.Context, user *User, required ...string) error {
+	var body json.RawMessage
+	if err := json.NewDecoder(c.Request().Body).Decode(&body); err != nil || json.Unmarshal(body, user) != nil {
+		return badRequest(codeInvalidBody, "", "Request body must be a JSON user")
+	}
+	if err := requireFields(body, required...); err != nil {
+		return err
+	}
+	return validateUser(*user)
+}
+
+// decodeGroup is decodeUser for a Group. It isn't validated, since prepareGroup does that.
+func decodeGroup(c echo.Context, group *Group, required ...string) error {
+	var body json.RawMessage
+	if err := json.NewDecoder(c.Request().Body).Decode(&body); err != nil || json.Unmarshal(body, group) != nil {
+		return badRequest(codeInvalidBody, "", "Request body must be a JSON group")
+	}
+	return requireFields(body, required...)
+}
+
+// createUser adds a user to the passwd file
+func createUser(c echo.Context) error {
+	var user User
+	if err := decodeUser(c, &user, "uid", "gid"); err != nil {
+		return err
+	}
+	if err := editPasswdFile(addUserLine(user)); err != nil {
+		return err
+	}
+	c.Response().Header().Set("ETag", userETag(user))
+	return c.JSON(http.StatusCreated, callerPolicies(c).redactUser(user))
+}
+
+// updateUser replaces the user with the UID in the path
+// The UID itself can't be changed - delete and re-create the user instead
+func updateUser(c echo.Context) error {
+	query, err := parseQueryParams(paramsMap(c))
+	if err != nil {
+		return err
+	}
+	uid := query["uid"].(int)
+	return saveUser(c, uid, User{UID: uid}, "gid")
+}
+
+// patchUser changes only the fields given in the request body of the user with the UID in the path
+func patchUser(c echo.Context) error {
+	query, err := parseQueryParams(paramsMap(c))
+	if err != nil {
+		return err
+	}
+	users := userDB.Query(query)
+	if len(users) == 0 {
+		return errUserNotFound
+	}
+	// If the user changed on disk since userDB was loaded, If-Match fails rather than
+	// the patch being applied to stale fields
+	return saveUser(c, users[0].UID, users[0])
+}
+
+// saveUser decodes the request body over user and writes it in place of the user with a UID
+func saveUser(c echo.Context, uid int, user User, required ...string) error {
+	if err := decodeUser(c, &user, required...); err != nil {
+		return err
+	}
+	if user.UID != uid {
+		return badRequest(codeInvalidParam, "uid", "'uid' can't be changed")
+	}
+	if err := editPasswdFile(ifMatchUser(uid, c.Request().Header.Get("If-Match"), updateUserLine(uid, user))); err != nil {
+		return err
+	}
+	c.Response().Header().Set("ETag", userETag(user))
+	return c.JSON(http.StatusOK, callerPolicies(c).redactUser(user))
+}
+
+// deleteUser removes the user with the UID in the path
+func deleteUser(c echo.Context) error {
+	query, err := parseQueryParams(paramsMap(c))
+	if err != nil {
+		return err
+	}
+	uid := query["uid"].(int)
+	if err = editPasswdFile(ifMatchUser(uid, c.Request().Header.Get("If-Match"), deleteUserLine(uid))); err != nil {
+		return err
 	}
-	return c.JSON(http.StatusOK, result[0])
+	return c.NoContent(http.StatusNoContent)
 }
 
 /***** GROUP ENDPOINTS *****/
 
 func getGroups(c echo.Context) error {
-	return c.JSON(http.StatusOK, groupDB.Query(nil))
+	return render(c, http.StatusOK, visibleGroups(c, nil))
 }
 
 func queryGroups(c echo.Context) error {
 	query, err := parseQueryParams(c.QueryParams())
 	if err != nil {
-		return c.String(http.StatusBadRequest, err.Error())
+		return err
 	}
-	return c.JSON(http.StatusOK, groupDB.Query(query))
+	return render(c, http.StatusOK, visibleGroups(c, query))
 }
 
 func getGroupsByMember(c echo.Context) error {
 	query, err := parseQueryParams(paramsMap(c))
 	if err != nil {
-		return c.String(http.StatusBadRequest, err.Error())
+		return err
 	}
-	memberResults := userDB.Query(query)
+	memberResults := visibleUsers(c, query)
 	if len(memberResults) == 0 {
-		return c.String(http.StatusNotFound, "User not found")
+		return errUserNotFound
 	}
 	query["members"] = []string{memberResults[0].Name}
-	return c.JSON(http.StatusOK, groupDB.Query(query))
+	return render(c, http.StatusOK, visibleGroups(c, query))
+}
+
+// getUserIdentity returns what `id <user>` prints, as JSON or as plain text if the client accepts it
+func getUserIdentity(c echo.Context) error {
+	query, err := parseQueryParams(paramsMap(c))
+	if err != nil {
+		return err
+	}
+	users := visibleUsers(c, query)
+	if len(users) == 0 {
+		return errUserNotFound
+	}
+	ident := buildIdentity(users[0], visibleGroups(c, nil))
+	if strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMETextPlain) {
+		return c.String(http.StatusOK, ident.String())
+	}
+	return c.JSON(http.StatusOK, ident)
 }
 
 func getGroupByGID(c echo.Context) error {
 	query, err := parseQueryParams(paramsMap(c))
 	if err != nil {
-		return c.String(http.StatusBadRequest, err.Error())
+		return err
 	}
 	result := groupDB.Query(query)
-	if len(result) == 0 {
-		return c.String(http.StatusNotFound, "Group not found")
+	set := callerPolicies(c)
+	if len(result) == 0 || set.hidesGroup(result[0]) {
+		return errGroupNotFound
+	}
+	group := redactedGroup(c, result[0])
+	if resourceNotModified(c, visibleETag(c, !reflect.DeepEqual(group, result[0]), groupETag(result[0]), redactedGroupETag(group))) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return render(c, http.StatusOK, group)
+}
+
+// GroupBatchResult is the outcome of looking up a single key in a group batch
+type GroupBatchResult struct {
+	Found bool   `json:"found"`
+	Group *Group `json:"group,omitempty"`
+}
+
+// batchGroups resolves a list of GIDs and names to groups in a single request
+func batchGroups(c echo.Context) error {
+	keys, err := parseBatchKeys(c.Request().Body)
+	if err != nil {
+		return err
+	}
+	byGID := make(map[int]Group)
+	byName := make(map[string]Group)
+	groups := visibleGroups(c, nil)
+	for i := len(groups) - 1; i >= 0; i-- {
+		byGID[groups[i].GID] = groups[i]
+		byName[groups[i].Name] = groups[i]
+	}
+	out := make(map[string]GroupBatchResult, len(keys))
+	for _, key := range keys {
+		group, ok := byName[key]
+		if gid, err := strconv.Atoi(key); err == nil {
+			group, ok = byGID[gid]
+		}
+		if ok {
+			out[key] = GroupBatchResult{Found: true, Group: &group}
+		} else {
+			out[key] = GroupBatchResult{Found: false}
+		}
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// MemberRequest is the body of a request to add a user to a group
+type MemberRequest struct {
+	Name string `json:"name"`
+}
+
+// createGroup adds a group to the group file
+func createGroup(c echo.Context) error {
+	var group Group
+	if err := decodeGroup(c, &group, "gid"); err != nil {
+		return err
+	}
+	if err := prepareGroup(&group, userDB.Query(nil)); err != nil {
+		return err
+	}
+	if err := editGroupFile(addGroupLine(group)); err != nil {
+		return err
+	}
+	c.Response().Header().Set("ETag", groupETag(group))
+	return c.JSON(http.StatusCreated, redactedGroup(c, group))
+}
+
+// deleteGroup removes the group with the GID in the path
+// Like groupdel, a group can't be deleted while it is still some user's primary group
+func deleteGroup(c echo.Context) error {
+	query, err := parseQueryParams(paramsMap(c))
+	if err != nil {
+		return err
+	}
+	gid := query["gid"].(int)
+	if err = requireNotPrimaryGroup(userDB.Query(nil), gid); err != nil {
+		return err
+	}
+	if err = editGroupFile(ifMatchGroup(gid, c.Request().Header.Get("If-Match"), deleteGroupLine(gid))); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// addGroupMember adds a user to the supplementary members of a group, like `gpasswd -a`
+func addGroupMember(c echo.Context) error {
+	query, err := parseQueryParams(paramsMap(c))
+	if err != nil {
+		return err
+	}
+	var member MemberRequest
+	if err = json.NewDecoder(c.Request().Body).Decode(&member); err != nil {
+		return badRequest(codeInvalidBody, "", "Request body must be a JSON object with a 'name'")
+	}
+	if err = requireUsers(userDB.Query(nil), []string{member.Name}, "name"); err != nil {
+		return err
+	}
+	gid := query["gid"].(int)
+	var group Group
+	if err = editGroupFile(ifMatchGroup(gid, c.Request().Header.Get("If-Match"), editMembersLine(gid, addMember(member.Name), &group))); err != nil {
+		return err
+	}
+	c.Response().Header().Set("ETag", groupETag(group))
+	return c.JSON(http.StatusOK, redactedGroup(c, group))
+}
+
+// removeGroupMember removes a user from the supplementary members of a group, like `gpasswd -d`
+func removeGroupMember(c echo.Context) error {
+	gid, err := strconv.Atoi(c.Param("gid"))
+	if err != nil {
+		return badRequest(codeInvalidParam, "gid", "'gid' must be an integer")
+	}
+	var group Group
+	if err = editGroupFile(ifMatchGroup(gid, c.Request().Header.Get("If-Match"), editMembersLine(gid, removeMember(c.Param("name")), &group))); err != nil {
+		return err
+	}
+	c.Response().Header().Set("ETag", groupETag(group))
+	return c.JSON(http.StatusOK, redactedGroup(c, group))
+}
+
+/***** GETENT ENDPOINTS *****/
+
+// getentPasswd lists users as passwd lines, like `getent passwd [key]`
+// The key can be a name or a UID. Like getent, an unknown key is an error (404).
+func getentPasswd(c echo.Context) error {
+	users := visibleUsers(c, nil)
+	if key := c.Param("key"); key != "" {
+		user, ok := findUserByKey(users, key)
+		if !ok {
+			return errUserNotFound
+		}
+		users = []User{user}
+	}
+	var lines strings.Builder
+	for _, user := range users {
+		lines.WriteString(formatPasswdLine(user) + "\n")
+	}
+	return c.String(http.StatusOK, lines.String())
+}
+
+// getentGroup lists groups as group lines, like `getent group [key]`
+func getentGroup(c echo.Context) error {
+	groups := visibleGroups(c, nil)
+	if key := c.Param("key"); key != "" {
+		group, ok := findGroupByKey(groups, key)
+		if !ok {
+			return errGroupNotFound
+		}
+		groups = []Group{group}
+	}
+	var lines strings.Builder
+	for _, group := range groups {
+		lines.WriteString(formatGroupLine(group) + "\n")
 	}
-	return c.JSON(http.StatusOK, result[0])
+	return c.String(http.StatusOK, lines.String())
 }
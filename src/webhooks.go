@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+	Webhooks POST the change events of each reload to the URLs in the -webhooks config file,
+	filtered by event type. Every webhook has its own queue, so deliveries to one URL arrive
+	in order and a slow receiver doesn't hold up the others. Failed deliveries are retried
+	with exponential backoff, and given up on after webhookMaxAttempts - these dead letters
+	are logged, kept for GET /admin/webhooks, and appended to the dead letter log if configured.
+*/
+
+// Webhook delivery headers. The signature is the hex HMAC-SHA256 of the body, keyed with
+// the webhook's secret, like "sha256=5d41...".
+const (
+	headerWebhookSignature = "X-Pwaas-Signature"
+	headerWebhookDelivery  = "X-Pwaas-Delivery"
+)
+
+// webhookMaxAttempts is how many times a delivery is tried before it becomes a dead letter
+var webhookMaxAttempts = 6
+
+// webhookBackoff is the wait before the first retry, doubling up to webhookMaxBackoff
+var webhookBackoff = time.Second
+var webhookMaxBackoff = 5 * time.Minute
+
+// webhookQueueSize is how many deliveries can wait for a webhook before new ones are dead-lettered
+const webhookQueueSize = 1000
+
+// maxDeadLetters is how many dead letters GET /admin/webhooks shows
+const maxDeadLetters = 100
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// WebhookConfig is a webhook in the -webhooks config file. Events are patterns like
+// "user.added", "group.*" or "*", and an empty list means every event.
+type WebhookConfig struct {
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret"`
+	Events []string `yaml:"events"`
+}
+
+// webhooksFile is the format of the -webhooks config file
+type webhooksFile struct {
+	DeadLetterLog string          `yaml:"dead_letter_log"`
+	Webhooks      []WebhookConfig `yaml:"webhooks"`
+}
+
+// WebhookPayload is the JSON body of a webhook delivery: the matching changes of one reload
+type WebhookPayload struct {
+	Delivery string        `json:"delivery"`
+	Events   []ChangeEvent `json:"events"`
+}
+
+// DeliveryAttempt is the outcome of one attempt to deliver a payload
+type DeliveryAttempt struct {
+	Delivery   string    `json:"delivery"`
+	Attempt    int       `json:"attempt"`
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// WebhookStatus reports on the deliveries to a webhook. Secrets are never shown.
+type WebhookStatus struct {
+	URL         string           `json:"url"`
+	Events      []string         `json:"events"`
+	Pending     int              `json:"pending"`
+	Delivered   int              `json:"delivered"`
+	Failed      int              `json:"failed"`
+	LastAttempt *DeliveryAttempt `json:"last_attempt,omitempty"`
+}
+
+// DeadLetter is a payload that couldn't be delivered
+type DeadLetter struct {
+	URL      string         `json:"url"`
+	Payload  WebhookPayload `json:"payload"`
+	Attempts int            `json:"attempts"`
+	Error    string         `json:"error"`
+	At       time.Time      `json:"at"`
+}
+
+// WebhooksStatus is the response of GET /admin/webhooks
+type WebhooksStatus struct {
+	Webhooks    []WebhookStatus `json:"webhooks"`
+	DeadLetters []DeadLetter    `json:"dead_letters"`
+}
+
+// webhook is a configured webhook with its delivery queue
+type webhook struct {
+	config WebhookConfig
+	queue  chan WebhookPayload
+	lock   sync.Mutex
+	status WebhookStatus
+}
+
+// webhooks are started by loadWebhooks, and receive the events published by setUsers and setGroups
+var webhooks []*webhook
+
+var deadLetterLog string
+var deadLetters []DeadLetter
+var deadLettersLock sync.Mutex
+
+// loadWebhooks reads the -webhooks config file and starts delivering to its webhooks
+func loadWebhooks(configPath string) error {
+	text, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	var config webhooksFile
+	if err := yaml.UnmarshalStrict(text, &config); err != nil {
+		return err
+	}
+	for _, hook := range config.Webhooks {
+		if hook.URL == "" {
+			return fmt.Errorf("webhook without a url")
+		}
+		// An empty HMAC key would let anyone sign payloads
+		if hook.Secret == "" {
+			return fmt.Errorf("webhook %s without a secret", hook.URL)
+		}
+		for _, pattern := range hook.Events {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid event pattern '%s' for %s", pattern, hook.URL)
+			}
+		}
+	}
+	deadLetterLog = config.DeadLetterLog
+	webhooks = startWebhooks(config.Webhooks)
+	return nil
+}
+
+// startWebhooks starts a delivery goroutine for each webhook
+func startWebhooks(configs []WebhookConfig) []*webhook {
+	hooks := make([]*webhook, len(configs))
+	for i, config := range configs {
+		filters := config.Events
+		if filters == nil {
+			filters = []string{}
+		}
+		hook := &webhook{
+			config: config,
+			queue:  make(chan WebhookPayload, webhookQueueSize),
+			status: WebhookStatus{URL: config.URL, Events: filters},
+		}
+		go hook.run()
+		hooks[i] = hook
+	}
+	return hooks
+}
+
+// wants checks whether an event type matches the webhook's filters
+func (hook *webhook) wants(eventType string) bool {
+	if len(hook.config.Events) == 0 {
+		return true
+	}
+	for _, pattern := range hook.config.Events {
+		if ok, _ := path.Match(pattern, eventType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyWebhooks queues the changes each webhook wants for delivery
+func notifyWebhooks(changes []ChangeEvent) {
+	for _, hook := range webhooks {
+		payload := WebhookPayload{Delivery: newDeliveryID()}
+		for _, event := range changes {
+			if hook.wants(event.Type) {
+				payload.Events = append(payload.Events, event)
+			}
+		}
+		if len(payload.Events) == 0 {
+			continue
+		}
+		hook.lock.Lock()
+		hook.status.Pending++
+		hook.lock.Unlock()
+		select {
+		case hook.queue <- payload:
+		default:
+			hook.finish(payload, 0, fmt.Errorf("delivery queue is full"))
+		}
+	}
+}
+
+func newDeliveryID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// run delivers queued payloads in order, retrying each with exponential backoff
+func (hook *webhook) run() {
+	for payload := range hook.queue {
+		backoff := webhookBackoff
+		var err error
+		attempt := 1
+		for ; ; attempt++ {
+			if err = hook.deliver(payload, attempt); err == nil || attempt == webhookMaxAttempts {
+				break
+			}
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > webhookMaxBackoff {
+				backoff = webhookMaxBackoff
+			}
+		}
+		hook.finish(payload, attempt, err)
+	}
+}
+
+// deliver POSTs a signed payload once. Any response other than 2xx is a failure.
+func (hook *webhook) deliver(payload WebhookPayload, attempt int) (err error) {
+	result := DeliveryAttempt{Delivery: payload.Delivery, Attempt: attempt, At: time.Now()}
+	defer func() {
+		if err != nil {
+			result.Error = err.Error()
+		}
+		hook.lock.Lock()
+		hook.status.LastAttempt = &result
+		hook.lock.Unlock()
+	}()
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, hook.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(headerWebhookDelivery, payload.Delivery)
+	req.Header.Set(headerWebhookSignature, "sha256="+webhookSignature(hook.config.Secret, body))
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	result.StatusCode = res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("receiver responded %s", res.Status)
+	}
+	return nil
+}
+
+// webhookSignature is the hex HMAC-SHA256 of a body
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// finish records the outcome of a payload, dead-lettering it if err is set
+func (hook *webhook) finish(payload WebhookPayload, attempts int, err error) {
+	hook.lock.Lock()
+	hook.status.Pending--
+	if err == nil {
+		hook.status.Delivered++
+	} else {
+		hook.status.Failed++
+	}
+	hook.lock.Unlock()
+	if err != nil {
+		recordDeadLetter(DeadLetter{URL: hook.config.URL, Payload: payload, Attempts: attempts, Error: err.Error(), At: time.Now()})
+	}
+}
+
+// recordDeadLetter logs an undeliverable payload, keeping the latest maxDeadLetters for the status page
+func recordDeadLetter(letter DeadLetter) {
+	log.Printf("Webhook: giving up on delivery %s to %s after %d attempts: %s", letter.Payload.Delivery, letter.URL, letter.Attempts, letter.Error)
+	deadLettersLock.Lock()
+	defer deadLettersLock.Unlock()
+	deadLetters = append(deadLetters, letter)
+	if len(deadLetters) > maxDeadLetters {
+		deadLetters = deadLetters[len(deadLetters)-maxDeadLetters:]
+	}
+	if deadLetterLog == "" {
+		return
+	}
+	line, _ := json.Marshal(letter)
+	file, err := os.OpenFile(deadLetterLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Println("Webhook: can't write dead letter log:", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		log.Println("Webhook: can't write dead letter log:", err)
+	}
+}
+
+// getWebhooks reports on webhook deliveries and lists the latest dead letters
+func getWebhooks(c echo.Context) error {
+	status := WebhooksStatus{Webhooks: []WebhookStatus{}}
+	for _, hook := range webhooks {
+		hook.lock.Lock()
+		status.Webhooks = append(status.Webhooks, hook.status)
+		hook.lock.Unlock()
+	}
+	deadLettersLock.Lock()
+	status.DeadLetters = append([]DeadLetter{}, deadLetters...)
+	deadLettersLock.Unlock()
+	return c.JSON(http.StatusOK, status)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadWebhooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pwaas")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func() { webhooks, deadLetterLog = nil, "" }()
+	config := filepath.Join(dir, "webhooks.yaml")
+
+	assert.NoError(t, ioutil.WriteFile(config, []byte(`
+dead_letter_log: /tmp/dead.jsonl
+webhooks:
+  - url: http://localhost:9999/hook
+    secret: s3cret
+    events: [user.*, group.member_added]
+  - url: http://localhost:9999/all
+    secret: s3cret2
+`), 0644))
+	assert.NoError(t, loadWebhooks(config))
+	assert.Len(t, webhooks, 2)
+	assert.Equal(t, "/tmp/dead.jsonl", deadLetterLog)
+	assert.True(t, webhooks[0].wants(eventUserRemoved))
+	assert.True(t, webhooks[0].wants(eventMemberAdded))
+	assert.False(t, webhooks[0].wants(eventGroupAdded))
+	assert.True(t, webhooks[1].wants(eventGroupAdded))
+
+	for _, invalid := range []string{
+		"webhooks:\n  - secret: s3cret\n",
+		"webhooks:\n  - url: http://localhost/\n",
+		"webhooks:\n  - url: http://localhost/\n    secret: ''\n",
+		"webhooks:\n  - url: http://localhost/\n    secret: s3cret\n    events: ['[user']\n",
+		"webhooks:\n  - url: http://localhost/\n    secret: s3cret\n    retries: 3\n",
+	} {
+		assert.NoError(t, ioutil.WriteFile(config, []byte(invalid), 0644))
+		assert.Error(t, loadWebhooks(config), invalid)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pwaas")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	oldBackoff, oldAttempts := webhookBackoff, webhookMaxAttempts
+	webhookBackoff, webhookMaxAttempts = time.Millisecond, 3
+	deadLetterLog = filepath.Join(dir, "dead.jsonl")
+	adminToken = "secret"
+	defer func() {
+		webhookBackoff, webhookMaxAttempts = oldBackoff, oldAttempts
+		webhooks, deadLetters, deadLetterLog, adminToken = nil, nil, "", ""
+	}()
+
+	// Fails twice before accepting deliveries
+	var lock sync.Mutex
+	attempts := 0
+	var received []*http.Request
+	var bodies [][]byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if attempts++; attempts <= 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received, bodies = append(received, r), append(bodies, body)
+	}))
+	defer receiver.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer broken.Close()
+	webhooks = startWebhooks([]WebhookConfig{
+		{URL: receiver.URL, Secret: "s3cret", Events: []string{"user.*"}},
+		{URL: broken.URL, Events: []string{"group.*"}},
+	})
+
+	users, groups := userDB.Query(nil), groupDB.Query(nil)
+	defer userDB.SetUserList(users...)
+	defer groupDB.SetGroupList(groups...)
+	setUsers(append(users, User{Name: "hooked", UID: 4243, GID: 4243, Home: "/home/hooked", Shell: "/bin/sh"}))
+	setGroups(append(groups, Group{Name: "hooked", GID: 4243}))
+
+	eventually(t, func() bool {
+		webhooks[0].lock.Lock()
+		defer webhooks[0].lock.Unlock()
+		return webhooks[0].status.Delivered == 1
+	}, "webhook delivery")
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Len(t, received, 1)
+	req, body := received[0], bodies[0]
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, "sha256="+webhookSignature("s3cret", body), req.Header.Get(headerWebhookSignature))
+	var payload WebhookPayload
+	assert.NoError(t, json.Unmarshal(body, &payload))
+	assert.Equal(t, req.Header.Get(headerWebhookDelivery), payload.Delivery)
+	assert.Len(t, payload.Events, 1)
+	assert.Equal(t, eventUserAdded, payload.Events[0].Type)
+	assert.Equal(t, "hooked", payload.Events[0].User.Name)
+
+	eventually(t, func() bool {
+		deadLettersLock.Lock()
+		defer deadLettersLock.Unlock()
+		return len(deadLetters) == 1
+	}, "dead letter")
+	log, err := ioutil.ReadFile(deadLetterLog)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(log), "\n"))
+
+	rec := httptest.NewRecorder()
+	req = httptest.NewRequest(echo.GET, "/v1/admin/webhooks", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer secret")
+	newServer().ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "s3cret")
+	var status WebhooksStatus
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.Equal(t, 1, status.Webhooks[0].Delivered)
+	assert.Equal(t, 3, status.Webhooks[0].LastAttempt.Attempt)
+	assert.Equal(t, http.StatusOK, status.Webhooks[0].LastAttempt.StatusCode)
+	assert.Equal(t, 1, status.Webhooks[1].Failed)
+	assert.Equal(t, 0, status.Webhooks[1].Pending)
+	assert.Equal(t, broken.URL, status.DeadLetters[0].URL)
+	assert.Equal(t, 3, status.DeadLetters[0].Attempts)
+	assert.Contains(t, status.DeadLetters[0].Error, "502")
+}